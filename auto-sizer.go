@@ -0,0 +1,198 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+const DefaultAutoSizeInterval = time.Second
+
+// AutoSizerConfig configures an AutoSizer, the zero value of each field
+// selects its default.
+type AutoSizerConfig struct {
+	// the cgroup filesystem the cpu limit is read from, DefaultCgroupRoot
+	// by default. Within a container having its own cgroup namespace it is
+	// the cgroup of the container itself.
+	CgroupRoot string
+	// maps the number of cpu available to the number of P, DefaultReserve
+	// by default
+	Reserve func(nCPU int) int
+	// how often the cpu limit and GOMAXPROCS are polled,
+	// DefaultAutoSizeInterval by default
+	Interval time.Duration
+	// returns the current GOMAXPROCS, runtime.GOMAXPROCS(0) by default
+	GOMAXPROCS func() int
+}
+
+// AutoSizer keeps the number of P of a Workers in line with the cpu
+// available to the process, i.e. the smaller one of GOMAXPROCS and the cgroup
+// cpu quota, see Workers.SetMaxP.
+type AutoSizer struct {
+	w   *Workers
+	cfg AutoSizerConfig
+	*tickLoop
+}
+
+// DefaultReserve leaves some of nCPU to the non-cpu-intensive goroutines,
+// e.g. the ones doing network io, and returns the rest as the number of P.
+func DefaultReserve(nCPU int) int {
+	if nCPU <= 2 {
+		return 1
+	}
+	if nCPU <= 5 {
+		return nCPU - 1
+	}
+	if nCPU <= 7 {
+		return nCPU - 2
+	}
+	return nCPU - (nCPU / 4)
+}
+
+// NewAutoSizer creates an AutoSizer of w, it does nothing until Start.
+func NewAutoSizer(w *Workers, cfg AutoSizerConfig) *AutoSizer {
+	assert(w != nil)
+	if cfg.CgroupRoot == "" {
+		cfg.CgroupRoot = DefaultCgroupRoot
+	}
+	if cfg.Reserve == nil {
+		cfg.Reserve = DefaultReserve
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultAutoSizeInterval
+	}
+	if cfg.GOMAXPROCS == nil {
+		cfg.GOMAXPROCS = func() int {
+			return runtime.GOMAXPROCS(0)
+		}
+	}
+	return &AutoSizer{
+		w:        w,
+		cfg:      cfg,
+		tickLoop: newTickLoop(),
+	}
+}
+
+// CalcP returns the number of P the Workers should have now. An unreadable
+// cgroup cpu limit is reported as err, together with the number of P
+// calculated from GOMAXPROCS alone.
+func (a *AutoSizer) CalcP() (p int, err error) {
+	nCPU := a.cfg.GOMAXPROCS()
+	limit, ok, err := ReadCgroupCPULimit(a.cfg.CgroupRoot)
+	if ok {
+		if n := int(math.Ceil(limit)); n < nCPU {
+			nCPU = n
+		}
+	}
+	if nCPU < 1 {
+		nCPU = 1
+	}
+	p = a.cfg.Reserve(nCPU)
+	if p < 1 {
+		p = 1
+	}
+	return p, err
+}
+
+// Resize applies CalcP to the Workers once and returns the new number of P.
+func (a *AutoSizer) Resize() (p int, err error) {
+	p, err = a.CalcP()
+	if p != a.w.GetMaxP() {
+		a.w.SetMaxP(p)
+	}
+	return p, err
+}
+
+// Start resizes the Workers at once and then every Interval, until Stop is
+// called or the Workers is closed. It does nothing if a has been started or
+// stopped already.
+func (a *AutoSizer) Start() {
+	a.start(a.cfg.Interval, a.w.exitCh, func() {
+		a.Resize()
+	}, true)
+}
+
+// Stop stops the AutoSizer, if started, and waits for it; the number of P
+// is left as it is.
+func (a *AutoSizer) Stop() {
+	a.stop()
+}
+
+var errCgroupFormat = errors.New("cpuworker: malformed cgroup cpu limit")
+
+// ReadCgroupCPULimit returns the cpu limit, in number of cpu, set on the
+// cgroup mounted at root. cgroup v2 (cpu.max) is tried first and then cgroup
+// v1 (cpu.cfs_quota_us and cpu.cfs_period_us in the cpu controller). ok is
+// false if no limit is set or could be read.
+func ReadCgroupCPULimit(root string) (limit float64, ok bool, err error) {
+	bs, err := os.ReadFile(filepath.Join(root, "cpu.max"))
+	if err == nil {
+		// "$MAX $PERIOD", $MAX is "max" if not limited
+		fields := strings.Fields(string(bs))
+		if len(fields) != 2 {
+			return 0, false, errCgroupFormat
+		}
+		if fields[0] == "max" {
+			return 0, false, nil
+		}
+		return cgroupLimit(fields[0], fields[1])
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, false, err
+	}
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		quota, err := os.ReadFile(filepath.Join(root, dir, "cpu.cfs_quota_us"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		period, err := os.ReadFile(filepath.Join(root, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			return 0, false, err
+		}
+		// -1 if not limited
+		if strings.TrimSpace(string(quota)) == "-1" {
+			return 0, false, nil
+		}
+		return cgroupLimit(string(quota), string(period))
+	}
+	// no cgroup, e.g. not on linux
+	return 0, false, nil
+}
+
+func cgroupLimit(quota, period string) (limit float64, ok bool, err error) {
+	q, err := strconv.ParseInt(strings.TrimSpace(quota), 10, 64)
+	if err != nil {
+		return 0, false, errCgroupFormat
+	}
+	p, err := strconv.ParseInt(strings.TrimSpace(period), 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false, errCgroupFormat
+	}
+	if q <= 0 {
+		return 0, false, nil
+	}
+	return float64(q) / float64(p), true, nil
+}
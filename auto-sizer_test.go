@@ -0,0 +1,161 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCgroup lays out files, by their path relative to the root, in a fake
+// cgroup tree and returns its root
+func writeCgroup(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestReadCgroupCPULimit(t *testing.T) {
+	cases := []struct {
+		name  string
+		files map[string]string
+		limit float64
+		ok    bool
+		err   error
+	}{
+		{"none", nil, 0, false, nil},
+		{"v2 max", map[string]string{"cpu.max": "max 100000\n"}, 0, false, nil},
+		{"v2 limited", map[string]string{"cpu.max": "250000 100000\n"}, 2.5, true, nil},
+		{"v2 one field", map[string]string{"cpu.max": "250000\n"}, 0, false, errCgroupFormat},
+		{"v2 not a number", map[string]string{"cpu.max": "lots 100000\n"}, 0, false, errCgroupFormat},
+		{"v2 zero period", map[string]string{"cpu.max": "250000 0\n"}, 0, false, errCgroupFormat},
+		{"v2 empty", map[string]string{"cpu.max": ""}, 0, false, errCgroupFormat},
+		{"v1 unlimited", map[string]string{
+			"cpu/cpu.cfs_quota_us":  "-1\n",
+			"cpu/cpu.cfs_period_us": "100000\n",
+		}, 0, false, nil},
+		{"v1 limited", map[string]string{
+			"cpu/cpu.cfs_quota_us":  "150000\n",
+			"cpu/cpu.cfs_period_us": "100000\n",
+		}, 1.5, true, nil},
+		{"v1 cpuacct", map[string]string{
+			"cpu,cpuacct/cpu.cfs_quota_us":  "400000\n",
+			"cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+		}, 4, true, nil},
+		{"v1 malformed quota", map[string]string{
+			"cpu/cpu.cfs_quota_us":  "1.5e5\n",
+			"cpu/cpu.cfs_period_us": "100000\n",
+		}, 0, false, errCgroupFormat},
+		{"v1 malformed period", map[string]string{
+			"cpu/cpu.cfs_quota_us":  "150000\n",
+			"cpu/cpu.cfs_period_us": "\n",
+		}, 0, false, errCgroupFormat},
+		{"v2 before v1", map[string]string{
+			"cpu.max":               "100000 100000\n",
+			"cpu/cpu.cfs_quota_us":  "400000\n",
+			"cpu/cpu.cfs_period_us": "100000\n",
+		}, 1, true, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			limit, ok, err := ReadCgroupCPULimit(writeCgroup(t, c.files))
+			if limit != c.limit || ok != c.ok || !errors.Is(err, c.err) {
+				t.Fatalf("got (%v, %v, %v), want (%v, %v, %v)", limit, ok, err, c.limit, c.ok, c.err)
+			}
+		})
+	}
+}
+
+func TestAutoSizerCalcP(t *testing.T) {
+	w, err := NewWorkersWithOptions(WithP(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close(context.Background())
+	cases := []struct {
+		name       string
+		files      map[string]string
+		gomaxprocs int
+		p          int
+		err        error
+	}{
+		// DefaultReserve(8)
+		{"v2 max", map[string]string{"cpu.max": "max 100000"}, 8, 6, nil},
+		// the quota rounded up, DefaultReserve(3)
+		{"v2 limited", map[string]string{"cpu.max": "250000 100000"}, 8, 2, nil},
+		// GOMAXPROCS is below the quota
+		{"v2 above GOMAXPROCS", map[string]string{"cpu.max": "1600000 100000"}, 4, 3, nil},
+		{"v1 unlimited", map[string]string{
+			"cpu/cpu.cfs_quota_us":  "-1",
+			"cpu/cpu.cfs_period_us": "100000",
+		}, 8, 6, nil},
+		// falls back to GOMAXPROCS alone
+		{"malformed", map[string]string{"cpu.max": "a b c"}, 8, 6, errCgroupFormat},
+		{"GOMAXPROCS 1", nil, 1, 1, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gomaxprocs := c.gomaxprocs
+			a := NewAutoSizer(w, AutoSizerConfig{
+				CgroupRoot: writeCgroup(t, c.files),
+				GOMAXPROCS: func() int {
+					return gomaxprocs
+				},
+			})
+			p, err := a.CalcP()
+			if p != c.p || !errors.Is(err, c.err) {
+				t.Fatalf("got (%v, %v), want (%v, %v)", p, err, c.p, c.err)
+			}
+		})
+	}
+}
+
+func TestAutoSizerStop(t *testing.T) {
+	w, err := NewWorkersWithOptions(WithP(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close(context.Background())
+	root := writeCgroup(t, map[string]string{"cpu.max": "400000 100000"})
+
+	// never started
+	waitStopped(t, NewAutoSizer(w, AutoSizerConfig{CgroupRoot: root}).Stop)
+
+	a := NewAutoSizer(w, AutoSizerConfig{
+		CgroupRoot: root,
+		Interval:   time.Millisecond,
+		GOMAXPROCS: func() int {
+			return 8
+		},
+	})
+	a.Start()
+	a.Start()
+	if p := w.GetMaxP(); p != 3 {
+		t.Fatalf("resized to %d P, want 3", p)
+	}
+	waitStopped(t, a.Stop)
+}
@@ -0,0 +1,282 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command cpuworker-top shows a live, top-like view of the Workers of a
+// running process, by polling the JSON pages served by the
+// github.com/hnes/cpuworker/debug package:
+//
+//	cpuworker-top -addr localhost:8080 -workers global
+//
+// Every interval it shows the utilization of each P, the run queue lengths
+// by class, the rates of preemptions, yields and completions, the
+// percentiles of the queue wait, the P handoff delay and the time slice
+// overrun over the interval, and the tasks which have run the most.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hnes/cpuworker"
+)
+
+var (
+	addr     = flag.String("addr", "localhost:8080", "host:port of the process serving /debug/cpuworker/")
+	workers  = flag.String("workers", "global", "name of the Workers, see debug.Register")
+	interval = flag.Duration("interval", time.Second, "time between refreshes")
+	nTasks   = flag.Int("n", 10, "number of tasks shown")
+	once     = flag.Bool("once", false, "print a single view, one interval apart from the first poll, and exit")
+)
+
+// the JSON of the stats page
+type stats struct {
+	Time             time.Time
+	QueueLen         map[string]int
+	PBusy            int
+	PIdle            int
+	Submitted        uint64
+	Completed        uint64
+	Dropped          uint64
+	Yielded          uint64
+	EventCalled      uint64
+	Preemptions      uint64
+	QueueWait        cpuworker.Histogram
+	PHandoffDelay    cpuworker.Histogram
+	TimeSliceOverrun cpuworker.Histogram
+	P                []pSlot
+}
+
+type pSlot struct {
+	Idx        int
+	State      string
+	TaskID     uint64
+	Class      string
+	RunningFor time.Duration
+	LentTime   time.Duration
+}
+
+// the JSON of the tasks page
+type task struct {
+	ID      uint64
+	Name    string
+	Stat    string
+	Class   string
+	CPUTime time.Duration
+	Age     time.Duration
+}
+
+type sample struct {
+	stats stats
+	tasks []task
+}
+
+func get(page string, v interface{}) error {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     *addr,
+		Path:     "/debug/cpuworker/" + page,
+		RawQuery: url.Values{"workers": {*workers}, "format": {"json"}}.Encode(),
+	}
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", u.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func poll() (*sample, error) {
+	var s sample
+	if err := get("stats", &s.stats); err != nil {
+		return nil, err
+	}
+	if err := get("tasks", &s.tasks); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// since returns the durations h has observed since prev
+func since(h, prev cpuworker.Histogram) cpuworker.Histogram {
+	d := cpuworker.Histogram{
+		Bounds: h.Bounds,
+		Counts: make([]uint64, len(h.Counts)),
+		Count:  h.Count - prev.Count,
+		Sum:    h.Sum - prev.Sum,
+	}
+	for i := range d.Counts {
+		d.Counts[i] = h.Counts[i]
+		if i < len(prev.Counts) {
+			d.Counts[i] -= prev.Counts[i]
+		}
+	}
+	return d
+}
+
+func percentiles(h cpuworker.Histogram) string {
+	if h.Count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("p50 %-8v p90 %-8v p99 %-8v (%d)", h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99), h.Count)
+}
+
+func rate(cur, prev uint64, dt time.Duration) float64 {
+	return float64(cur-prev) / dt.Seconds()
+}
+
+func percent(d, dt time.Duration) float64 {
+	return 100 * float64(d) / float64(dt)
+}
+
+func show(out io.Writer, prev, cur *sample) {
+	st, pst := &cur.stats, &prev.stats
+	dt := st.Time.Sub(pst.Time)
+	if dt <= 0 {
+		dt = *interval
+	}
+
+	prevLent := make(map[int]time.Duration, len(pst.P))
+	for _, p := range pst.P {
+		prevLent[p.Idx] = p.LentTime
+	}
+	var lent time.Duration
+	alive := 0
+	for _, p := range st.P {
+		if p.State == cpuworker.PStateRetired {
+			continue
+		}
+		alive++
+		lent += p.LentTime - prevLent[p.Idx]
+	}
+	var util float64
+	if alive > 0 {
+		util = percent(lent, dt*time.Duration(alive))
+	}
+	queued := 0
+	var classes []string
+	for class, n := range st.QueueLen {
+		queued += n
+		classes = append(classes, fmt.Sprintf("%s=%d", class, n))
+	}
+	sort.Strings(classes)
+	queueWait := since(st.QueueWait, pst.QueueWait)
+
+	fmt.Fprintf(out, "cpuworker-top  %s  workers=%s  %s  every %v\n\n",
+		*addr, *workers, st.Time.Format("15:04:05"), *interval)
+	fmt.Fprintf(out, "P       %d busy, %d idle, %.1f%% utilized\n", st.PBusy, st.PIdle, util)
+	fmt.Fprintf(out, "queued  %d %s\n", queued, strings.Join(classes, " "))
+	fmt.Fprintf(out, "rates   %.0f submitted/s  %.0f completed/s  %.0f preemptions/s  %.0f yields/s  %.0f event calls/s\n",
+		rate(st.Submitted, pst.Submitted, dt), rate(st.Completed, pst.Completed, dt),
+		rate(st.Preemptions, pst.Preemptions, dt), rate(st.Yielded, pst.Yielded, dt),
+		rate(st.EventCalled, pst.EventCalled, dt))
+	fmt.Fprintf(out, "queue wait          %s\n", percentiles(queueWait))
+	fmt.Fprintf(out, "P handoff delay     %s\n", percentiles(since(st.PHandoffDelay, pst.PHandoffDelay)))
+	fmt.Fprintf(out, "time slice overrun  %s\n", percentiles(since(st.TimeSliceOverrun, pst.TimeSliceOverrun)))
+	if st.PIdle == 0 && queued > 0 && util >= 90 {
+		fmt.Fprintf(out, "\n!! saturated: every P is busy and %d tasks are queued, p99 queue wait %v\n",
+			queued, queueWait.Quantile(0.99))
+	} else {
+		fmt.Fprintf(out, "\nnot saturated\n")
+	}
+
+	fmt.Fprintln(out)
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "P\tSTATE\tUTIL\tTASK\tCLASS\tRUNNING FOR\t")
+	for _, p := range st.P {
+		if p.State == cpuworker.PStateRetired {
+			continue
+		}
+		taskID, running := "", ""
+		if p.TaskID != 0 {
+			taskID = fmt.Sprint(p.TaskID)
+			running = p.RunningFor.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%.1f%%\t%s\t%s\t%s\t\n", p.Idx, p.State,
+			percent(p.LentTime-prevLent[p.Idx], dt), taskID, p.Class, running)
+	}
+	tw.Flush()
+
+	// the tasks which have run the most over the interval, then overall
+	prevCPU := make(map[uint64]time.Duration, len(prev.tasks))
+	for _, t := range prev.tasks {
+		prevCPU[t.ID] = t.CPUTime
+	}
+	type busy struct {
+		task
+		recent time.Duration
+	}
+	ts := make([]busy, len(cur.tasks))
+	for i, t := range cur.tasks {
+		ts[i] = busy{t, t.CPUTime - prevCPU[t.ID]}
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].recent != ts[j].recent {
+			return ts[i].recent > ts[j].recent
+		}
+		return ts[i].CPUTime > ts[j].CPUTime
+	})
+	if len(ts) > *nTasks {
+		ts = ts[:*nTasks]
+	}
+	fmt.Fprintf(out, "\n%d live tasks\n", len(cur.tasks))
+	tw = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tNAME\tSTAT\tCLASS\tCPU%\tCPU TIME\tAGE\t")
+	for _, t := range ts {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%.1f%%\t%v\t%v\t\n", t.ID, t.Name, t.Stat, t.Class,
+			percent(t.recent, dt), t.CPUTime.Round(time.Microsecond), t.Age.Round(time.Millisecond))
+	}
+	tw.Flush()
+}
+
+func main() {
+	flag.Parse()
+	prev, err := poll()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cpuworker-top:", err)
+		os.Exit(1)
+	}
+	for {
+		time.Sleep(*interval)
+		cur, err := poll()
+		if !*once {
+			// clear the screen
+			fmt.Print("\033[H\033[2J")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cpuworker-top:", err)
+			if *once {
+				os.Exit(1)
+			}
+			continue
+		}
+		show(os.Stdout, prev, cur)
+		if *once {
+			return
+		}
+		prev = cur
+	}
+}
@@ -15,7 +15,15 @@
 package cpuworker
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"runtime"
+	"runtime/debug"
+	"runtime/trace"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,15 +32,18 @@ import (
 var glWorkers *Workers
 var glWorkersLock sync.Mutex
 
-var traceFlag = true
-
 // duration between (task repay p to scheduler, scheduler rcv this p )
-var traceMaxPdelay = time.Duration(0)
+// accessed atomically, a time.Duration
+var traceMaxPdelay int64
 
 const DefaultMaxTimeSlice = time.Microsecond * 1000
 const MaxEITaskTimeslice = time.Microsecond * 100
 const MaxNewTaskTimeslice = time.Microsecond * 200
 
+// MaxPLimit bounds what SetMaxP can grow a Workers to, unless it was created
+// with more P than that
+const MaxPLimit = 1024
+
 func init() {
 	cpuP := CalcAutoP()
 	workers := NewWorkers(cpuP, DefaultMaxTimeSlice)
@@ -46,6 +57,16 @@ const (
 	STAT_END
 )
 
+// Task.event
+const (
+	// a task never started has no event, its watcher hands it over as is
+	// once dropped, see Task.watch
+	taskEventNone = iota
+	taskEventYield
+	taskEventEventCallReturn
+	taskEventEnd
+)
+
 type TaskHandle struct {
 	// closed indicating the task is ended
 	done chan struct{}
@@ -56,10 +77,77 @@ type TaskHandle struct {
 	yieldCh chan *P
 	// receive one struct from this chan indicating current cpu worker should to be resumed
 	resumeCh chan *P
+	// set before done is closed
+	err error
+	// re-panic in Sync if the task panicked
+	repanic bool
+	// set before done is closed
+	acct TaskAccounting
+	// the id of the task, 0 if it was submitted after Close
+	id uint64
 }
 
+// ID returns the id of the task, allocated in the order of submission and
+// unique within its Workers. It is 0 if the task was submitted after Close.
+func (h *TaskHandle) ID() uint64 {
+	return h.id
+}
+
+// Sync waits for the task to end. If the task panicked and the Workers is
+// set to SetRepanicOnSync(true), Sync panics with the *PanicError.
 func (h *TaskHandle) Sync() {
 	<-h.done
+	h.maybeRepanic()
+}
+
+func (h *TaskHandle) maybeRepanic() {
+	if !h.repanic {
+		return
+	}
+	if perr, ok := h.err.(*PanicError); ok {
+		panic(perr)
+	}
+}
+
+// PanicError is the Err of a TaskHandle whose task panicked. The panic is
+// recovered in the task routine so that it would not crash the process, and
+// the P held by the task is given back to the scheduler. The panics of
+// cpuworker itself, on a broken invariant, are not recovered.
+type PanicError struct {
+	// the value passed to panic
+	Value interface{}
+	// the stack of the task routine when it panicked
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("cpuworker: task panicked: %v\n\n%s", e.Value, e.Stack)
+}
+
+// Unwrap returns Value if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Err returns why the task did not run to completion, e.g. ErrWorkersClosed
+// when it was submitted after Close, the error of its context when a task
+// submitted by SubmitCtx* was cancelled, ErrDeadlineExceeded when it did not
+// start before its deadline, or a *PanicError when the task panicked. It is
+// nil before the task ends.
+func (h *TaskHandle) Err() error {
+	select {
+	case <-h.done:
+		return h.err
+	default:
+		return nil
+	}
+}
+
+// finish records err and marks the task as ended
+func (h *TaskHandle) finish(err error) {
+	h.err = err
+	close(h.done)
 }
 
 type taskSchTiming struct {
@@ -86,18 +174,69 @@ type Task struct {
 	validFlag bool
 	// true: event intensive
 	// false: cpu intensive
+	// keep const after initialized, the eiFlag passed at submission
 	eventIntensiveFlag bool
 	// the bigger, the priority in scheduler would be higher
 	eventIntensiveScore float32
 	timing              taskSchTiming
+	// only accessed by the task routine, see TaskHandle.Accounting
+	acct taskAccounting
+	// set by WithTaskName and WithTaskLabels, kept const after submission
+	name   string
+	labels map[string]string
+	// kept const after submission
+	submitT time.Time
+	// mirrored for Workers.Tasks, accessed atomically: when stat was last
+	// changed in unix nanoseconds, the idx of the P held or -1, the class
+	// and the bits of timing.eIfactor
+	infoStatT    int64
+	infoP        int32
+	infoClass    int32
+	infoEIfactor uint32
+	// mirrors the cpu time of acct, accessed atomically
+	infoCPUTime int64
+	// the contexts carrying the pprof labels of each class, only accessed
+	// by the task routine, see setPprofLabels
+	labelCtxs [numTaskClasses]context.Context
+	// nil unless the task is traced, see WithRuntimeTrace. traceCtx and
+	// traceTask are kept const after submission, traceCurRegion is only
+	// accessed by the task routine
+	traceCtx       context.Context
+	traceTask      *trace.Task
+	traceCurRegion *trace.Region
 
-	stat int
-	fp0  func()
-	fp1  func(func())
-	fp2  func(func(func()))
-	h    TaskHandle
-	// must > 0
-	maxTimeSlice time.Duration
+	// accessed atomically, one of STAT_*
+	stat uint32
+	// unique within its Workers, allocated at submission
+	id  uint64
+	fp0 func()
+	fp1 func(func())
+	fp2 func(func(func()))
+	fp3 func(func(func()) error)
+	// never nil, context.Background() for tasks submitted without one
+	ctx context.Context
+	// set by the task routine once a checkpoint has reported ctx.Err()
+	cancelErr error
+	h         TaskHandle
+	// one of taskEvent*, written by the task routine right before t is
+	// sent to Workers.taskEventCh
+	event int
+	// the class it is running as, set by the scheduler from Policy.PickNext
+	class TaskClass
+	// when it became runnable the last time, set by the submitter or the
+	// task routine before t is handed over to the scheduler
+	queuedT time.Time
+	// owned by the Policy
+	policyData interface{}
+	// keep const after initialized, in [MinNice, MaxNice]
+	nice int
+	// keep const after initialized, zero means none
+	deadline time.Time
+	// guards the watchers and unwatched, see Task.watch
+	watchLock     sync.Mutex
+	unwatched     bool
+	stopCtxWatch  func() bool
+	deadlineTimer *time.Timer
 	// must > 0
 	// keep const after initialized
 	initMaxTimeSlice time.Duration
@@ -119,13 +258,60 @@ func (t *Task) assetValid() {
 	if t.fp2 != nil {
 		ct++
 	}
-	assert(ct == 1)
-	assert(t.stat == STAT_NEW || t.stat == STAT_RUNNING ||
-		t.stat == STAT_SUSPENDED || t.stat == STAT_END,
+	if t.fp3 != nil {
+		ct++
+	}
+	assert(ct == 1 && t.ctx != nil)
+	stat := t.loadStat()
+	assert(stat == STAT_NEW || stat == STAT_RUNNING ||
+		stat == STAT_SUSPENDED || stat == STAT_END,
 	)
 }
 
+func (t *Task) loadStat() uint32 {
+	return atomic.LoadUint32(&t.stat)
+}
+
+func (t *Task) storeStat(stat uint32) {
+	atomic.StoreUint32(&t.stat, stat)
+	atomic.StoreInt64(&t.infoStatT, time.Now().UnixNano())
+}
+
+func (t *Task) casStat(old, new uint32) bool {
+	if atomic.CompareAndSwapUint32(&t.stat, old, new) {
+		atomic.StoreInt64(&t.infoStatT, time.Now().UnixNano())
+		return true
+	}
+	return false
+}
+
+// StatString names a STAT_* value, e.g. TaskInfo.Stat.
+func StatString(stat uint32) string {
+	return statString(stat)
+}
+
+func statString(stat uint32) string {
+	switch stat {
+	case STAT_NEW:
+		return "new"
+	case STAT_RUNNING:
+		return "running"
+	case STAT_SUSPENDED:
+		return "suspended"
+	case STAT_END:
+		return "end"
+	}
+	return "unknown"
+}
+
+// the timing functions are called by the task routine, which also keeps
+// t.acct up to date with them
+
 func (t *Task) timingStart(tm time.Time) {
+	t.record(recStart, t.p, tm)
+	atomic.StoreInt32(&t.infoP, int32(t.p.idx))
+	t.acct.queueWait += tm.Sub(t.queuedT)
+	t.acct.eIfactor = t.timing.eIfactor
 	t.timing.resumeCpuT = zeroT
 	t.timing.suspendedCpuT = zeroT
 	t.timing.enterEventCallT = zeroT
@@ -134,39 +320,66 @@ func (t *Task) timingStart(tm time.Time) {
 	t.timing.resumeCpuT = tm
 }
 
-func (t *Task) timingCk(tm time.Time) {
+func (t *Task) timingCk(tm time.Time, p *P) {
+	t.record(recCk, p, tm)
+	atomic.StoreInt32(&t.infoP, -1)
 	t.timing.suspendedCpuT = tm
+	t.addRun(tm)
+	t.acct.yields++
 }
 
 func (t *Task) timingEnterEventCall(tm time.Time) {
+	t.record(recEnterEventCall, t.p, tm)
+	atomic.StoreInt32(&t.infoP, -1)
 	t.timing.suspendedCpuT = tm
 	t.timing.enterEventCallT = tm
+	t.addRun(tm)
+	t.acct.eventCalls++
 }
 
 func (t *Task) timingEndEventCall(tm time.Time) {
+	t.record(recEndEventCall, nil, tm)
 	t.timing.endEventCallT = tm
+	t.acct.eventCallTime += tm.Sub(t.timing.enterEventCallT)
 }
 
 func (t *Task) timingEnd(tm time.Time) {
+	t.record(recEnd, t.p, tm)
+	atomic.StoreInt32(&t.infoP, -1)
 	t.timing.suspendedCpuT = tm
+	t.addRun(tm)
+}
+
+// addRun accounts the run ending at tm
+func (t *Task) addRun(tm time.Time) {
+	d := tm.Sub(t.timing.resumeCpuT)
+	t.acct.addRun(t.class, d)
+	if d > 0 {
+		atomic.AddInt64(&t.infoCPUTime, int64(d))
+	}
 }
 
 /*
-	new ① (
-		(running ck ② runnable ① )
-		|
-		(running ③ eventCall ④ runnable ① )
-		|
-		(running ⑤ end)
-	)*
-
-	① timingStart
-	② timingCk repayP calcEIfactorAndSumbitToRunnableTaskQueue
-	③ timingEnterEventCall repayP
-	④ timingEndEventCall calcEIfactorAndSumbitToRunnableTaskQueue
-	⑤ timingEnd repayP
+new ① (
+
+	(running ck ② runnable ① )
+	|
+	(running ③ eventCall ④ runnable ① )
+	|
+	(running ⑤ end)
+
+)*
+
+① timingStart
+② timingCk repayP submitTaskEvent(taskEventYield)
+③ timingEnterEventCall repayP
+④ timingEndEventCall submitTaskEvent(taskEventEventCallReturn)
+⑤ timingEnd repayP submitTaskEvent(taskEventEnd)
+
+calcEIfactor is called by the scheduler routine on receiving the task events
+of ② and ④, before the Policy is told about them.
 */
-func (t *Task) calcEIfactorAndSumbitToRunnableTaskQueue() {
+func (t *Task) calcEIfactor() {
 	isCk := false
 	tm := &t.timing
 	push := func() {
@@ -178,7 +391,7 @@ func (t *Task) calcEIfactorAndSumbitToRunnableTaskQueue() {
 		assert(cpuDur >= 0 && eiDur >= 0 && tm.sumCpuDuration >= 0 && tm.sumEventCallDuration >= 0)
 	}
 	calcEiFactor := func() float32 {
-		if tm.suspendedCpuT.Sub(tm.resumeCpuT) >= time.Millisecond {
+		if tm.suspendedCpuT.Sub(tm.resumeCpuT) >= t.w.eiCPUCutoff {
 			return 0
 		}
 		eiDdiv10 := tm.sumEventCallDuration >> 3
@@ -215,166 +428,325 @@ func (t *Task) calcEIfactorAndSumbitToRunnableTaskQueue() {
 		eIfactor = calcEiFactor()
 	}
 
-	if eiFactorBt0(eIfactor) {
+	if eIfactor > t.w.eiThreshold {
 		tm.eiCt += 1
 		assert(tm.eiCt > 0)
 		tm.eIfactor = eIfactor
-		t.maxTimeSlice = t.initMaxTimeSlice
-		t.w.runnableEventIntensiveTaskCh <- t
 	} else {
 		eIfactor = 0
 		tm.eIfactor = eIfactor
 		tm.eiCt = 0
 		tm.sumCpuDuration = 0
 		tm.sumEventCallDuration = 0
-		t.maxTimeSlice = t.initMaxTimeSlice
-		t.w.runnableCpuIntensiveTaskCh <- t
 	}
+	atomic.StoreUint32(&t.infoEIfactor, math.Float32bits(tm.eIfactor))
 }
 
-// > 0
+// > 0, the eIfactor of a task is kept 0 by calcEIfactor unless it is above
+// the eiThreshold of its Workers
 func eiFactorBt0(factor float32) bool {
-	if factor > 0.0001 {
+	if factor > 0 {
 		return true
 	} else {
 		return false
 	}
 }
 
-func (t *Task) calcMaxTimeSlice() time.Duration {
-	var smallest time.Duration
-	if t.maxTimeSlice < t.initMaxTimeSlice {
-		smallest = t.maxTimeSlice
-	} else {
-		smallest = t.initMaxTimeSlice
+// run is the task routine. It is started by the first resume and labelled
+// with the pprof labels of the task context, see setPprofLabels.
+func (t *Task) run() {
+	t.p = <-t.pch
+	t.p.assetValid()
+	t.setPprofLabels()
+	defer func() {
+		var perr *PanicError
+		if r := recover(); r != nil {
+			if _, ok := r.(invariantViolation); ok {
+				// a bug of cpuworker, not of the task
+				panic(r)
+			}
+			perr = &PanicError{
+				Value: r,
+				Stack: debug.Stack(),
+			}
+		}
+		t.end(perr)
+	}()
+	t.traceRegion(traceRegionRunning)
+	t.timingStart(time.Now())
+	if t.w.hooks != nil {
+		t.w.hooks.OnStart(t.hookInfo())
 	}
-	if smallest < t.w.maxTimeSlice {
+	if t.fp1 != nil {
+		t.fp1(func() {
+			checkPoint(t)
+		})
+	} else if t.fp0 != nil {
+		t.fp0()
+	} else if t.fp2 != nil {
+		t.fp2(func(ecfp func()) {
+			if ecfp == nil {
+				checkPoint(t)
+			} else {
+				eventRoutineCall(t, ecfp)
+			}
+		})
 	} else {
-		smallest = t.w.maxTimeSlice
+		assert(t.fp3 != nil)
+		t.fp3(func(ecfp func()) error {
+			if ecfp == nil {
+				return checkPoint(t)
+			} else {
+				return eventRoutineCall(t, ecfp)
+			}
+		})
 	}
-	assert(smallest > 0)
-	return smallest
 }
 
 // start running a newTask or a suspended task
-func (t *Task) resume(p *P, eiFlag bool, newFlag bool) {
+// return false if it is a newTask which has been dropped, in which case p
+// is left untouched
+func (t *Task) resume(p *P) bool {
 	t.assetValid()
 	p.assetValid()
-	fixMaxTimeSlice := func() {
-		if eiFlag {
-			if t.initMaxTimeSlice > MaxEITaskTimeslice {
-				if t.maxTimeSlice > MaxEITaskTimeslice {
-					t.maxTimeSlice = MaxEITaskTimeslice
-				}
-			}
+	if stat := t.loadStat(); stat == STAT_NEW || stat == STAT_END {
+		if err := t.ctx.Err(); err != nil {
+			t.drop(err)
+			return false
 		}
-		if newFlag {
-			if t.initMaxTimeSlice > MaxNewTaskTimeslice {
-				if t.maxTimeSlice > MaxNewTaskTimeslice {
-					t.maxTimeSlice = MaxNewTaskTimeslice
-				}
-			}
+		if t.deadlineExceeded(time.Now()) {
+			t.drop(ErrDeadlineExceeded)
+			return false
 		}
-	}
-	if t.stat == STAT_NEW {
-		assert(t.p == nil)
-		t.p = p
-		finalFp := func() {
-			fixMaxTimeSlice()
-			t.timingStart(time.Now())
-			if t.fp1 != nil {
-				t.fp1(func() {
-					checkPoint(t)
-				})
-			} else if t.fp0 != nil {
-				t.fp0()
-			} else {
-				assert(t.fp2 != nil)
-				t.fp2(func(ecfp func()) {
-					if ecfp == nil {
-						checkPoint(t)
-					} else {
-						eventRoutineCall(t, ecfp)
-					}
-				})
-			}
-			t.p.assetValid()
-			nowT := time.Now()
-			if traceFlag {
-				t.p.taskRepayPt = nowT
-			}
-			t.w.repayP(t.p)
-			t.timingEnd(nowT)
-			t.p = nil
-			t.stat = STAT_END
-			close(t.h.done)
-			assert(len(t.pch) == 0)
-			close(t.pch)
-		}
-		t.stat = STAT_RUNNING
-		go finalFp()
+		// racing with the watchers
+		if !t.casStat(STAT_NEW, STAT_RUNNING) {
+			return false
+		}
+		t.unwatch()
+		t.assert(t.p == nil, "a new task holds a P")
+		tryMustSndPch(t.pch, p)
+		go t.run()
 	} else {
-		assert(t.stat == STAT_SUSPENDED && t.p == nil)
-		fixMaxTimeSlice()
+		t.assert(t.loadStat() == STAT_SUSPENDED && t.p == nil, "a resumed task is not suspended")
 		tryMustSndPch(t.pch, p)
 	}
+	return true
+}
+
+// end is called by the task routine once the task function has returned or
+// panicked with perr
+func (t *Task) end(perr *PanicError) {
+	// a task panicking inside its event routine does not hold a P any more
+	if t.p != nil {
+		t.p.assetValid()
+		nowT := time.Now()
+		if t.w.trace {
+			t.p.taskRepayPt = nowT
+		}
+		t.w.repayP(t.p)
+		t.timingEnd(nowT)
+		t.p = nil
+	}
+	t.storeStat(STAT_END)
+	t.h.acct = t.acct.export()
+	if t.w.hooks != nil {
+		t.w.hooks.OnEnd(t.hookInfo())
+	}
+	var err error
+	if perr != nil {
+		err = perr
+	} else if t.cancelErr != nil {
+		err = t.cancelErr
+	}
+	t.traceEnd(err)
+	t.submitTaskEvent(taskEventEnd)
+	t.h.finish(err)
+	t.assert(len(t.pch) == 0, "an ended task has been lent a P")
+	close(t.pch)
+	t.w.untrackTask(t)
+}
+
+func (t *Task) deadlineExceeded(now time.Time) bool {
+	return !t.deadline.IsZero() && !now.Before(t.deadline)
+}
+
+// drop ends a task which has never been started, it returns false if the
+// task has already been started or dropped
+func (t *Task) drop(err error) bool {
+	if !t.casStat(STAT_NEW, STAT_END) {
+		return false
+	}
+	t.unwatch()
+	atomic.AddUint64(&t.w.dropped, 1)
+	t.traceEnd(err)
+	t.h.acct = TaskAccounting{
+		QueueWait: time.Since(t.queuedT),
+	}
+	if t.w.hooks != nil {
+		t.w.hooks.OnEnd(t.hookInfo())
+	}
+	t.h.finish(err)
+	t.w.untrackTask(t)
+	return true
+}
+
+// watch arranges for the task to be dropped if its context is done or its
+// deadline has passed before it is started. It does nothing if the task has
+// been started or dropped already.
+func (t *Task) watch() {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+	if t.unwatched {
+		return
+	}
+	if t.ctx.Done() != nil {
+		t.stopCtxWatch = context.AfterFunc(t.ctx, func() {
+			t.dropWatched(t.ctx.Err())
+		})
+	}
+	if !t.deadline.IsZero() {
+		t.deadlineTimer = time.AfterFunc(time.Until(t.deadline), func() {
+			t.dropWatched(ErrDeadlineExceeded)
+		})
+	}
 }
 
-func checkPoint(t *Task) {
+// unwatch stops the watchers, it is called once the task is started or
+// dropped
+func (t *Task) unwatch() {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+	t.unwatched = true
+	if t.stopCtxWatch != nil {
+		t.stopCtxWatch()
+		t.stopCtxWatch = nil
+	}
+	if t.deadlineTimer != nil {
+		t.deadlineTimer.Stop()
+		t.deadlineTimer = nil
+	}
+}
+
+func (t *Task) dropWatched(err error) {
+	if t.drop(err) {
+		// let the policy forget about it at once, t.queuedT is left alone
+		// as the policy may still be looking at it. t.event is still
+		// taskEventNone, as no task routine has ever run.
+		t.w.taskEventCh <- t
+	}
+}
+
+// checkCtx returns the error of the task's context once it is done, and
+// records it as the reason why the task has ended early
+func (t *Task) checkCtx() error {
+	err := t.ctx.Err()
+	if err != nil && t.cancelErr == nil {
+		t.cancelErr = err
+	}
+	return err
+}
+
+// checkPoint yields if the scheduler has asked for it, and then returns the
+// error of the task's context if any. A pending yield is honoured even once
+// the context is done, so that a task ignoring the error is still preempted.
+func checkPoint(t *Task) error {
 	yieldFlag := atomic.LoadUint32(&t.h.yieldFlag)
 	if yieldFlag != 0 {
 		// should yield
-		assert(t.p != nil && t.stat == STAT_RUNNING)
+		t.assert(t.p != nil && t.loadStat() == STAT_RUNNING, "a task yielding is not running")
 		p := t.p
 		t.p = nil
-		t.stat = STAT_SUSPENDED
+		t.storeStat(STAT_SUSPENDED)
 		nowT := time.Now()
-		t.timingCk(nowT)
-		if traceFlag {
+		t.timingCk(nowT, p)
+		if t.w.trace {
 			p.taskRepayPt = nowT
 		}
 		atomic.StoreUint32(&t.h.yieldFlag, 0)
 		tryMustSndPch(t.w.availablePchan, p)
-		t.calcEIfactorAndSumbitToRunnableTaskQueue()
+		t.traceRegion(traceRegionCheckpoint)
+		if t.w.hooks != nil {
+			t.w.hooks.OnYield(t.hookInfo())
+		}
+		t.submitTaskEvent(taskEventYield)
 		// block at here untill scheduler wants us to resume
 		var ok bool
 		t.p, ok = <-t.pch
-		assert(ok)
+		t.assert(ok, "a suspended task has been dropped")
 		t.p.assetValid()
-		t.stat = STAT_RUNNING
+		t.storeStat(STAT_RUNNING)
+		t.setPprofLabels()
+		t.traceRegion(traceRegionRunning)
 		t.timingStart(time.Now())
+		if t.w.hooks != nil {
+			t.w.hooks.OnResume(t.hookInfo())
+		}
+		// the task may have been cancelled while it was suspended
+		return t.checkCtx()
 	}
+	return t.checkCtx()
 }
 
-func eventRoutineCall(t *Task, eventRoutineFp func()) {
+func eventRoutineCall(t *Task, eventRoutineFp func()) error {
+	if t.ctx.Err() != nil {
+		// the event routine is skipped, but a pending yield is not
+		return checkPoint(t)
+	}
 	nowT := time.Now()
 	t.timingEnterEventCall(nowT)
-	assert(t.p != nil && t.stat == STAT_RUNNING)
+	t.assert(t.p != nil && t.loadStat() == STAT_RUNNING, "a task calling an event routine is not running")
 	p := t.p
 	t.p = nil
-	assert(p.eventCallTask == nil)
+	t.assert(p.eventCallTask == nil, "the P of a task is already lent to an event call")
 	p.eventCallTask = t
-	t.stat = STAT_SUSPENDED
-	if traceFlag {
+	t.storeStat(STAT_SUSPENDED)
+	if t.w.trace {
 		p.taskRepayPt = nowT
 	}
 	tryMustSndPch(t.w.availablePchan, p)
+	t.traceRegion(traceRegionEventCall)
+	if t.w.hooks != nil {
+		t.w.hooks.OnEventCallEnter(t.hookInfo())
+	}
 	{
 		eventRoutineFp()
 	}
 	t.timingEndEventCall(time.Now())
-	t.calcEIfactorAndSumbitToRunnableTaskQueue()
+	t.traceRegion(traceRegionQueued)
+	if t.w.hooks != nil {
+		t.w.hooks.OnEventCallExit(t.hookInfo())
+	}
+	t.submitTaskEvent(taskEventEventCallReturn)
 	// block at here until scheduler wants us to resume
 	var ok bool
 	t.p, ok = <-t.pch
-	assert(ok)
+	t.assert(ok, "a task queued after an event call has been dropped")
 	t.p.assetValid()
-	t.stat = STAT_RUNNING
+	t.storeStat(STAT_RUNNING)
+	t.setPprofLabels()
+	t.traceRegion(traceRegionRunning)
 	t.timingStart(time.Now())
+	if t.w.hooks != nil {
+		t.w.hooks.OnResume(t.hookInfo())
+	}
+	return t.checkCtx()
+}
+
+// submitTaskEvent hands t over to the scheduler routine, the task routine
+// must not touch t.timing until t is resumed again
+func (t *Task) submitTaskEvent(ev int) {
+	t.event = ev
+	t.queuedT = time.Now()
+	t.w.taskEventCh <- t
 }
 
 func (t *Task) sendSuspendSignal() {
-	atomic.CompareAndSwapUint32(&t.h.yieldFlag, 0, 1)
+	if atomic.CompareAndSwapUint32(&t.h.yieldFlag, 0, 1) {
+		t.traceLog("preempted")
+		if t.w.hooks != nil {
+			t.w.hooks.OnPreemptSignal(t.hookInfo())
+		}
+	}
 }
 
 func tryMustRcvPch(pch chan *P) *P {
@@ -417,7 +789,15 @@ func (p *P) assetValid() {
 type taskSchUnit struct {
 	validFlag bool
 	resumeT   time.Time
+	// from Workers.calcTimeSlice
+	timeSlice time.Duration
 	taskPtr   *Task
+	// signalled to yield early on behalf of a Preempter policy
+	preempted bool
+	// when the task was signalled to yield, kept along with the rest after
+	// the unit is invalidated on a time slice timeout until the P is handed
+	// back
+	signalT time.Time
 }
 
 func (tu *taskSchUnit) assertValid() {
@@ -425,37 +805,106 @@ func (tu *taskSchUnit) assertValid() {
 }
 
 type Workers struct {
-	newTaskCh                    chan *Task
-	runnableEventIntensiveTaskCh chan *Task
-	runnableCpuIntensiveTaskCh   chan *Task
-	availablePchan               chan *P
-	// must > 0
-	maxTimeSlice time.Duration
+	newTaskCh chan *Task
+	// tasks which have yielded, returned from an event routine or ended,
+	// see Task.submitTaskEvent
+	taskEventCh    chan *Task
+	availablePchan chan *P
+	// accessed atomically, a time.Duration which must > 0, see
+	// SetMaxTimeSlice
+	maxTimeSlice int64
+	// only accessed by the scheduler routine
+	policy Policy
 	// idx is the idx of P, and member is taskSchUnit
 	taskSchArray []taskSchUnit
-	exitCh       chan struct{}
+	// a task whose eIfactor is not above eiThreshold, or which has run
+	// eiCPUCutoff or longer before yielding, is not event intensive, see
+	// calcEIfactor
+	eiThreshold float32
+	eiCPUCutoff time.Duration
+	// records traceMaxPdelay and Stats.PHandoffDelay
+	trace bool
+	// traces the tasks with runtime/trace, see WithRuntimeTrace
+	runtimeTrace bool
+	// set by WithWorkersName
+	name string
+	// the capacity of newTaskCh, only reported by Config
+	queueCap int
+	// labels the task routines, see WithPprofLabels
+	pprofLabels bool
+	// nil unless set by WithHooks, kept const after creation
+	hooks Hooks
+	// nil unless set by WithLogger
+	log *workersLog
+	// holds a *FlightRecorder, see SetFlightRecorder
+	recorder atomic.Value
+	// accessed atomically, non-zero makes TaskHandle.Sync re-panic
+	repanicOnSync uint32
+	// accessed atomically, the longest time a task of each class has
+	// waited in the run queues before being resumed
+	maxQueueWait [numTaskClasses]int64
+	// accessed atomically, the longest time a task has waited to be resumed
+	// after returning from an event routine call, since the last
+	// swapEIResumeDelay
+	eiResumeDelay int64
+	// accessed atomically, the number of P the scheduler resizes to, see
+	// SetMaxP
+	maxP int64
+	// accessed atomically, the number of P alive, idle or lent to a task
+	pInUse int64
+	// nudges the scheduler routine to apply maxP
+	resizeCh chan struct{}
+	// only accessed by the scheduler routine
+	stats schedStats
+	// requests a snapshot of stats from the scheduler routine, see Stats
+	statsCh chan statsReq
+	// the last snapshot of stats, taken before exitedCh is closed
+	finalStats Stats
+	// accessed atomically, tasks dropped without ever running
+	dropped uint64
+	// closed to stop the scheduler routine
+	exitCh chan struct{}
+	// closed by the scheduler routine when it returns
+	exitedCh chan struct{}
+
+	// the last task id allocated, accessed atomically
+	taskSeq uint64
+	// guards closed, tasks and drainedCh
+	lock   sync.Mutex
+	closed bool
+	// every submitted task which has not ended yet
+	tasks map[*Task]struct{}
+	// closed once Close has begun and tasks becomes empty
+	drainedCh chan struct{}
 }
 
 // if never timeout return (0, -1)
 // if there is a already timeout taskSchUnit return (0, validIdx)
 // otherwise normal return timeout > 0 and a valid idx
-func (w *Workers) calcDurationToNextTimeSliceTimeout() (timeout time.Duration, idx int) {
+// early is true if the task of idx is to be preempted before its time slice
+// is used up, as requested by a Preempter policy
+func (w *Workers) calcDurationToNextTimeSliceTimeout() (timeout time.Duration, idx int, early bool) {
 	var smallestSuspendT time.Time
 	validUnitCt := 0
+	// units already signalled by an early preemption
+	preemptedCt := 0
 	for i, v := range w.taskSchArray {
 		if v.validFlag {
-			validUnitCt++
 			v.assertValid()
+			if v.preempted {
+				preemptedCt++
+				continue
+			}
+			validUnitCt++
 		} else {
 			continue
 		}
-		maxTimeSlice := v.taskPtr.calcMaxTimeSlice()
 		assert(validUnitCt > 0)
 		if validUnitCt == 1 {
-			smallestSuspendT = v.resumeT.Add(maxTimeSlice)
+			smallestSuspendT = v.resumeT.Add(v.timeSlice)
 			idx = i
 		} else {
-			thisSuspendT := v.resumeT.Add(maxTimeSlice)
+			thisSuspendT := v.resumeT.Add(v.timeSlice)
 			if thisSuspendT.Before(smallestSuspendT) {
 				smallestSuspendT = thisSuspendT
 				idx = i
@@ -464,144 +913,276 @@ func (w *Workers) calcDurationToNextTimeSliceTimeout() (timeout time.Duration, i
 	}
 	if validUnitCt > 0 {
 	} else {
-		return 0, -1
+		return 0, -1, false
 	}
 	nowT := time.Now()
+	if preempter, ok := w.policy.(Preempter); ok {
+		at, n := preempter.PreemptAt(nowT)
+		if n > preemptedCt && at.Before(smallestSuspendT) {
+			// the victim is the preemptible task which has run the longest
+			victim := -1
+			for i, v := range w.taskSchArray {
+				if !v.validFlag || v.preempted || !preempter.Preemptible(v.taskPtr) {
+					continue
+				}
+				if victim < 0 || v.resumeT.Before(w.taskSchArray[victim].resumeT) {
+					victim = i
+				}
+			}
+			if victim >= 0 {
+				smallestSuspendT = at
+				idx = victim
+				early = true
+			}
+		}
+	}
 	w.taskSchArray[idx].assertValid()
 	if smallestSuspendT.After(nowT) {
-		return smallestSuspendT.Sub(nowT), idx
+		return smallestSuspendT.Sub(nowT), idx, early
 	} else {
-		return 0, idx
+		return 0, idx, early
 	}
 }
 
 func NewWorkers(p int, maxTimeSlice time.Duration) *Workers {
-	assert(p > 0)
+	return NewWorkersWithPolicy(p, maxTimeSlice, NewDefaultPolicy())
+}
+
+// NewWorkersWithPolicy is like NewWorkers but schedules the tasks with
+// policy, which must not be shared with any other Workers. The time slice
+// returned by policy is capped by maxTimeSlice.
+func NewWorkersWithPolicy(p int, maxTimeSlice time.Duration, policy Policy) *Workers {
+	assert(p > 0 && maxTimeSlice > 0 && policy != nil)
+	cfg := defaultWorkersConfig()
+	cfg.p = p
+	cfg.maxTimeSlice = maxTimeSlice
+	cfg.policy = policy
+	return newWorkers(&cfg)
+}
+
+// newWorkers creates a Workers from cfg, which must be valid
+func newWorkers(cfg *workersConfig) *Workers {
+	p := cfg.p
+	// every P alive must fit in availablePchan at the same time, see
+	// tryMustSndPch
+	pLimit := p
+	if pLimit < MaxPLimit {
+		pLimit = MaxPLimit
+	}
+	queueCap := cfg.queueCap
+	if queueCap == 0 {
+		queueCap = 1024 * p
+	}
 	w := Workers{
-		newTaskCh:                    make(chan *Task, 1024*p),
-		runnableEventIntensiveTaskCh: make(chan *Task, 1024*p),
-		runnableCpuIntensiveTaskCh:   make(chan *Task, 1024*p),
-		availablePchan:               make(chan *P, p),
-		maxTimeSlice:                 maxTimeSlice,
-		taskSchArray:                 make([]taskSchUnit, p),
-		exitCh:                       make(chan struct{}),
+		newTaskCh:      make(chan *Task, queueCap),
+		taskEventCh:    make(chan *Task, queueCap),
+		availablePchan: make(chan *P, pLimit),
+		maxTimeSlice:   int64(cfg.maxTimeSlice),
+		policy:         cfg.policy,
+		taskSchArray:   make([]taskSchUnit, p),
+		eiThreshold:    cfg.eiThreshold,
+		eiCPUCutoff:    cfg.eiCPUCutoff,
+		trace:          cfg.trace,
+		runtimeTrace:   cfg.runtimeTrace,
+		name:           cfg.name,
+		queueCap:       queueCap,
+		pprofLabels:    cfg.pprofLabels,
+		hooks:          cfg.hooks,
+		log:            newWorkersLog(cfg),
+		maxP:           int64(p),
+		pInUse:         int64(p),
+		resizeCh:       make(chan struct{}, 1),
+		statsCh:        make(chan statsReq),
+		exitCh:         make(chan struct{}),
+		exitedCh:       make(chan struct{}),
+		tasks:          make(map[*Task]struct{}),
+		drainedCh:      make(chan struct{}),
+	}
+	if cfg.repanicOnSync {
+		w.repanicOnSync = 1
 	}
+	w.recorder.Store(cfg.recorder)
 	for idx := range w.taskSchArray {
 		w.availablePchan <- &P{
 			validFlag: true,
 			idx:       idx,
 		}
 	}
+	w.logConfig()
 	go w.schedulerRoutine()
 	return &w
 }
 
+// calcTimeSlice asks the policy for the time slice of t and caps it
+func (w *Workers) calcTimeSlice(t *Task) time.Duration {
+	slice := w.policy.TimeSliceFor(t)
+	maxTimeSlice := w.GetMaxTimeSlice()
+	if slice <= 0 || slice > maxTimeSlice {
+		slice = maxTimeSlice
+	}
+	assert(slice > 0)
+	return slice
+}
+
 func (w *Workers) schedulerRoutine() {
+	defer close(w.exitedCh)
 	closedCh := make(chan time.Time, 1)
 	close(closedCh)
 	var nilCh chan time.Time
-	// eiT local buf
-	var eiTask *Task
-	eiTaskPq := newPrioTaskQueue()
-	// local cpuT buf
-	var cpuTask *Task
-	// local newT buf
-	var newTask *Task
+	policy := w.policy
 	// local p buf
 	var newp *P
 	var pArray []*P
-	tryToPushAllEiT := func() {
-		if eiTask != nil {
-			eiTaskPq.Push(eiTask, eiTask.timing.eIfactor)
-			eiTask = nil
+	// the P alive and the number of them wanted, see SetMaxP
+	pInUse := len(w.taskSchArray)
+	targetP := pInUse
+	// idx of the retired P, reused once grown again
+	var freeIdx []int
+	onNewTask := func(t *Task) {
+		t.assetValid()
+		w.stats.submitted++
+		w.logDrained()
+		if t.loadStat() == STAT_END {
+			// dropped before the policy has ever seen it
+			return
+		}
+		policy.Enqueue(t, time.Now())
+	}
+	onTaskEvent := func(t *Task) {
+		t.assetValid()
+		switch t.event {
+		case taskEventYield:
+			w.stats.yielded++
+			w.stats.addTiming(t)
+			t.calcEIfactor()
+			w.stats.eIfactor.observe(float64(t.timing.eIfactor))
+			policy.OnYield(t, time.Now())
+		case taskEventEventCallReturn:
+			w.stats.eventCalled++
+			w.stats.addTiming(t)
+			t.calcEIfactor()
+			w.stats.eIfactor.observe(float64(t.timing.eIfactor))
+			policy.OnEventCallReturn(t, time.Now())
+		case taskEventEnd:
+			w.stats.completed++
+			w.stats.addTiming(t)
+			policy.OnEnd(t)
+		case taskEventNone:
+			// dropped by its watcher. Unless the policy removes it, it is
+			// discarded once picked, or has already been
+			if remover, ok := policy.(Remover); ok && remover.Remove(t) {
+				policy.OnEnd(t)
+			}
+		default:
+			assert(false)
 		}
+	}
+	// new tasks are left in newTaskCh once the policy has queued as many
+	// as it could hold, so that submitters are throttled
+	newTaskChIfNotFull := func() chan *Task {
+		if policy.Len() < cap(w.newTaskCh) {
+			return w.newTaskCh
+		}
+		return nil
+	}
+	tryToPushAllT := func() {
 		for {
-			var eiT *Task
+			var t *Task
 			select {
-			case eiT = <-w.runnableEventIntensiveTaskCh:
-				eiT.assetValid()
+			case t = <-w.taskEventCh:
 			default:
 			}
-			if eiT != nil {
-				eiTaskPq.Push(eiT, eiT.timing.eIfactor)
+			if t != nil {
+				onTaskEvent(t)
 			} else {
 				break
 			}
 		}
-	}
-	// return (task, eiFlag, newFlag)
-	mustGetTnb := func() (*Task, bool, bool) {
-		// priority:
-		//   eIQ > newQ > cIQ
-		tryToPushAllEiT()
-		if eiTaskPq.Len() > 0 {
-			return eiTaskPq.Pop().t, true, false
-		}
-		var ret *Task
-		if newTask != nil {
-			ret = newTask
-			newTask = nil
-			return ret, false, true
-		}
-		select {
-		case ret = <-w.newTaskCh:
-			return ret, false, true
-		default:
-		}
-		if cpuTask != nil {
-			ret = cpuTask
-			cpuTask = nil
-			return ret, false, false
-		}
-		// try to get one runnable task
-		select {
-		case ret = <-w.newTaskCh:
-			return ret, false, true
-		case ret = <-w.runnableCpuIntensiveTaskCh:
-			return ret, false, false
-		default:
+		for {
+			var t *Task
+			select {
+			case t = <-newTaskChIfNotFull():
+			default:
+			}
+			if t != nil {
+				onNewTask(t)
+			} else {
+				break
+			}
 		}
-		panic("unexpected")
 	}
 	hasTask := func() bool {
-		if eiTask != nil || newTask != nil || cpuTask != nil ||
-			eiTaskPq.Len() > 0 || len(w.newTaskCh) > 0 ||
-			len(w.runnableCpuIntensiveTaskCh) > 0 ||
-			len(w.runnableEventIntensiveTaskCh) > 0 {
-			return true
-		} else {
-			return false
+		return policy.Len() > 0
+	}
+	retireP := func(p *P) {
+		p.validFlag = false
+		freeIdx = append(freeIdx, p.idx)
+		pInUse--
+		atomic.StoreInt64(&w.pInUse, int64(pInUse))
+	}
+	// resizeP applies SetMaxP, the P lent to the tasks are retired by
+	// pushNewP once they are handed back
+	resizeP := func() {
+		targetP = int(atomic.LoadInt64(&w.maxP))
+		assert(targetP > 0)
+		for pInUse < targetP {
+			var idx int
+			if n := len(freeIdx); n > 0 {
+				idx = freeIdx[n-1]
+				freeIdx = freeIdx[0 : n-1]
+			} else {
+				idx = len(w.taskSchArray)
+				w.taskSchArray = append(w.taskSchArray, taskSchUnit{})
+			}
+			assert(!w.taskSchArray[idx].validFlag)
+			pArray = append(pArray, &P{
+				validFlag: true,
+				idx:       idx,
+			})
+			pInUse++
+		}
+		for pInUse > targetP && len(pArray) > 0 {
+			p := pArray[len(pArray)-1]
+			pArray = pArray[0 : len(pArray)-1]
+			retireP(p)
 		}
+		atomic.StoreInt64(&w.pInUse, int64(pInUse))
 	}
 	pushNewP := func(newp *P) {
 		assert(newp != nil)
 		newp.assetValid()
-		if traceFlag && newp.taskRepayPt != zeroT {
-			d := time.Now().Sub(newp.taskRepayPt)
-			if d > traceMaxPdelay {
-				traceMaxPdelay = d
-			}
+		nowT := time.Now()
+		if w.trace && newp.taskRepayPt != zeroT {
+			d := nowT.Sub(newp.taskRepayPt)
+			observeMax(&traceMaxPdelay, d)
+			w.stats.pHandoffDelay.observe(d)
 		}
 		tu := w.taskSchArray[newp.idx]
 		if tu.validFlag {
 			tu.assertValid()
-			w.taskSchArray[newp.idx] = taskSchUnit{}
 		}
+		if !tu.signalT.IsZero() {
+			w.stats.timeSliceOverrun.observe(nowT.Sub(tu.signalT))
+		}
+		if tu.taskPtr != nil {
+			w.stats.addLent(newp.idx, nowT.Sub(tu.resumeT))
+			w.logSlowTask(tu.taskPtr, newp.idx, tu.resumeT, tu.timeSlice, nowT)
+		}
+		w.taskSchArray[newp.idx] = taskSchUnit{}
 		if newp.eventCallTask != nil {
 			t := newp.eventCallTask
 			if tu.validFlag {
-				assert(tu.taskPtr == t)
+				t.assert(tu.taskPtr == t, "the P of an event call is held by another task")
 			}
 			newp.eventCallTask = nil
 		}
+		if pInUse > targetP {
+			retireP(newp)
+			return
+		}
 		pArray = append(pArray, newp)
-		newp = nil
 	}
 	tryToPushAllP := func() {
-		if newp != nil {
-			pushNewP(newp)
-			newp = nil
-		}
 		for {
 			var p *P
 			select {
@@ -617,19 +1198,36 @@ func (w *Workers) schedulerRoutine() {
 		}
 	}
 	mustGetPnb := func() *P {
-		tryToPushAllP()
 		assert(len(pArray) > 0)
 		p := pArray[len(pArray)-1]
 		pArray = pArray[0 : len(pArray)-1]
 		return p
 	}
 	hasP := func() bool {
-		return newp != nil || len(pArray) > 0 || len(w.availablePchan) > 0
+		return len(pArray) > 0
 	}
+	snapshot := func(runQueue bool) Stats {
+		st := w.stats.snapshot(w, policy, len(pArray), pInUse-len(pArray))
+		st.P = w.pSlots(pArray, freeIdx)
+		if runQueue {
+			st.RunQueue = runQueueInfo(policy)
+		}
+		return st
+	}
+	// runs before exitedCh is closed
+	defer func() {
+		w.finalStats = snapshot(false)
+	}()
 
 	for {
 		assert(newp == nil)
+		select {
+		case <-w.resizeCh:
+			resizeP()
+		default:
+		}
 		tryToPushAllP()
+		tryToPushAllT()
 		if hasP() {
 			goto P_AVAILABLE
 		}
@@ -637,54 +1235,87 @@ func (w *Workers) schedulerRoutine() {
 			goto NO_P_AND_HAS_RUNNABLE_TASK
 		}
 		goto NO_P_AND_NO_RUNNABLE_TASK
-	NEW_P:
-		{
-			pushNewP(newp)
-			newp = nil
-			goto P_AVAILABLE
-		}
 	P_AVAILABLE:
 		{
 			assert(hasP())
 			if hasTask() {
 			} else {
+				var t *Task
 				select {
 				case newp = <-w.availablePchan:
-					goto NEW_P
-				case newTask = <-w.newTaskCh:
-				case eiTask = <-w.runnableEventIntensiveTaskCh:
-				case cpuTask = <-w.runnableCpuIntensiveTaskCh:
+					pushNewP(newp)
+					newp = nil
+				case t = <-w.newTaskCh:
+					onNewTask(t)
+				case req := <-w.statsCh:
+					req.reply <- snapshot(req.runQueue)
+				case t = <-w.taskEventCh:
+					onTaskEvent(t)
+				case <-w.resizeCh:
+					resizeP()
+				case <-w.exitCh:
+					return
 				}
-				goto P_AVAILABLE_AND_HAS_RUNNABLE_TASK
+				goto GOTO_NEXT_LOOP
 			}
 		}
-	P_AVAILABLE_AND_HAS_RUNNABLE_TASK:
+		// P_AVAILABLE_AND_HAS_RUNNABLE_TASK
 		{
 			thisP := mustGetPnb()
-			thisT, eiFlag, newFlag := mustGetTnb()
-			w.taskSchArray[thisP.idx] = taskSchUnit{
-				validFlag: true,
-				resumeT:   time.Now(),
-				taskPtr:   thisT,
+			nowT := time.Now()
+			thisT, class := policy.PickNext(nowT)
+			assert(thisT != nil)
+			thisT.class = class
+			atomic.StoreInt32(&thisT.infoClass, int32(class))
+			// everything the scheduler needs from thisT must be read before
+			// resume, the task routine owns it again as soon as it runs
+			wait := nowT.Sub(thisT.queuedT)
+			timeSlice := w.calcTimeSlice(thisT)
+			eventCallReturn := thisT.event == taskEventEventCallReturn
+			if thisT.resume(thisP) {
+				w.observeQueueWait(class, wait)
+				w.stats.queueWait.observe(wait)
+				thisT.traceLog("resumed class=%s p=%d wait=%v slice=%v", class, thisP.idx, wait, timeSlice)
+				if eventCallReturn {
+					observeMax(&w.eiResumeDelay, wait)
+				}
+				w.taskSchArray[thisP.idx] = taskSchUnit{
+					validFlag: true,
+					resumeT:   nowT,
+					timeSlice: timeSlice,
+					taskPtr:   thisT,
+				}
+			} else {
+				// cancelled before it ever ran, thisP is still idle
+				pArray = append(pArray, thisP)
+				policy.OnEnd(thisT)
 			}
-			thisT.resume(thisP, eiFlag, newFlag)
 			goto GOTO_NEXT_LOOP
 		}
 	NO_P_AND_NO_RUNNABLE_TASK:
 		{
+			var t *Task
 			select {
 			case newp = <-w.availablePchan:
-				goto NEW_P
-			case newTask = <-w.newTaskCh:
-			case eiTask = <-w.runnableEventIntensiveTaskCh:
-			case cpuTask = <-w.runnableCpuIntensiveTaskCh:
+				pushNewP(newp)
+				newp = nil
+			case t = <-w.newTaskCh:
+				onNewTask(t)
+			case req := <-w.statsCh:
+				req.reply <- snapshot(req.runQueue)
+			case t = <-w.taskEventCh:
+				onTaskEvent(t)
+			case <-w.resizeCh:
+				resizeP()
+			case <-w.exitCh:
+				return
 			}
-			goto NO_P_AND_HAS_RUNNABLE_TASK
+			goto GOTO_NEXT_LOOP
 		}
 	NO_P_AND_HAS_RUNNABLE_TASK:
 		{
 			var timeoutCh <-chan time.Time
-			timeout, idx := w.calcDurationToNextTimeSliceTimeout()
+			timeout, idx, early := w.calcDurationToNextTimeSliceTimeout()
 			var timer *time.Timer
 			if idx < 0 {
 				timeoutCh = nilCh
@@ -698,22 +1329,51 @@ func (w *Workers) schedulerRoutine() {
 					timeoutCh = timer.C
 				}
 			}
+			var t *Task
 			select {
 			case <-timeoutCh:
 				tu := w.taskSchArray[idx]
 				tu.assertValid()
-				w.taskSchArray[idx] = taskSchUnit{}
-				tu.taskPtr.sendSuspendSignal()
-				if timer != nil {
-					timer.Stop()
+				w.stats.preemptions++
+				if fr := w.getFlightRecorder(); fr != nil {
+					kind := recPreempt
+					if early {
+						kind = recPreemptEarly
+					}
+					fr.record(kind, idx, tu.taskPtr.id, tu.taskPtr.class, time.Now())
 				}
-				goto GOTO_NEXT_LOOP
+				if early {
+					// kept until its P is back so that it is counted
+					// against the preemptions the policy asked for
+					w.taskSchArray[idx].preempted = true
+					w.taskSchArray[idx].signalT = time.Now()
+				} else {
+					// invalidated, but the rest is kept for Stats.P
+					w.taskSchArray[idx].validFlag = false
+					w.taskSchArray[idx].signalT = time.Now()
+				}
+				tu.taskPtr.sendSuspendSignal()
 			case newp = <-w.availablePchan:
+				pushNewP(newp)
+				newp = nil
+			case t = <-newTaskChIfNotFull():
+				onNewTask(t)
+			case req := <-w.statsCh:
+				req.reply <- snapshot(req.runQueue)
+			case t = <-w.taskEventCh:
+				onTaskEvent(t)
+			case <-w.resizeCh:
+				resizeP()
+			case <-w.exitCh:
 				if timer != nil {
 					timer.Stop()
 				}
-				goto NEW_P
+				return
+			}
+			if timer != nil {
+				timer.Stop()
 			}
+			goto GOTO_NEXT_LOOP
 		}
 	GOTO_NEXT_LOOP:
 		assert(newp == nil)
@@ -721,55 +1381,228 @@ func (w *Workers) schedulerRoutine() {
 	}
 }
 
+func (w *Workers) observeQueueWait(class TaskClass, d time.Duration) {
+	if class < 0 || class >= numTaskClasses {
+		return
+	}
+	observeMax(&w.maxQueueWait[class], d)
+}
+
+// observeMax raises the time.Duration at addr to d atomically
+func observeMax(addr *int64, d time.Duration) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if int64(d) <= old || atomic.CompareAndSwapInt64(addr, old, int64(d)) {
+			return
+		}
+	}
+}
+
+// swapEIResumeDelay returns the longest time a task has waited to be resumed
+// after returning from an event routine call since the last call, and
+// starts over
+func (w *Workers) swapEIResumeDelay() time.Duration {
+	return time.Duration(atomic.SwapInt64(&w.eiResumeDelay, 0))
+}
+
+// GetMaxQueueWait returns the worst time a task picked as class has waited
+// in the run queues so far, from becoming runnable until being resumed.
+func (w *Workers) GetMaxQueueWait(class TaskClass) time.Duration {
+	if class < 0 || class >= numTaskClasses {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&w.maxQueueWait[class]))
+}
+
+// SetRepanicOnSync controls whether the Sync of tasks submitted afterwards
+// re-panics in its caller when the task has panicked. It is off by default,
+// in which case the panic is only reported by TaskHandle.Err.
+func (w *Workers) SetRepanicOnSync(on bool) {
+	var v uint32
+	if on {
+		v = 1
+	}
+	atomic.StoreUint32(&w.repanicOnSync, v)
+}
+
+// Name returns the name set by WithWorkersName.
+func (w *Workers) Name() string {
+	return w.name
+}
+
+// FlightRecorder returns the FlightRecorder set by SetFlightRecorder or
+// WithFlightRecorder, nil if none.
+func (w *Workers) FlightRecorder() *FlightRecorder {
+	return w.getFlightRecorder()
+}
+
+// GetMaxTimeSlice returns the longest time slice any task of w may run for
+// before being asked to yield.
+func (w *Workers) GetMaxTimeSlice() time.Duration {
+	return time.Duration(atomic.LoadInt64(&w.maxTimeSlice))
+}
+
+// SetMaxTimeSlice changes the cap on the time slice of every task, it takes
+// effect from the next time a task is resumed. d must > 0.
+func (w *Workers) SetMaxTimeSlice(d time.Duration) {
+	assert(d > 0)
+	atomic.StoreInt64(&w.maxTimeSlice, int64(d))
+}
+
+// GetMaxP returns the number of P, i.e. how many tasks may run at the same
+// time, that w is sized to. See GetPInUse for how many are actually alive.
 func (w *Workers) GetMaxP() int {
+	return int(atomic.LoadInt64(&w.maxP))
+}
+
+// GetPInUse returns the number of P alive, idle or lent to a task. It stays
+// above GetMaxP after a shrink until the running tasks hand theirs back.
+func (w *Workers) GetPInUse() int {
+	return int(atomic.LoadInt64(&w.pInUse))
+}
+
+// GetPLimit returns the largest number of P SetMaxP can grow w to.
+func (w *Workers) GetPLimit() int {
 	return cap(w.availablePchan)
 }
 
+// SetMaxP resizes w to n P, n is clamped to [1, GetPLimit()]. Growing takes
+// effect at once. Shrinking retires the idle P at once and the others as
+// their tasks hand them back.
+func (w *Workers) SetMaxP(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if limit := w.GetPLimit(); n > limit {
+		n = limit
+	}
+	atomic.StoreInt64(&w.maxP, int64(n))
+	select {
+	case w.resizeCh <- struct{}{}:
+	default:
+		// already nudged, maxP is loaded once the scheduler wakes up
+	}
+}
+
 func (w *Workers) Submit(fp0 func()) *TaskHandle {
-	return w.submit(fp0, nil, nil, DefaultMaxTimeSlice, false)
+	return w.submit(context.Background(), fp0, nil, nil, nil, DefaultMaxTimeSlice, false, nil)
 }
 
 func (w *Workers) Submit1(fp1 func(func())) *TaskHandle {
-	return w.submit(nil, fp1, nil, DefaultMaxTimeSlice, false)
+	return w.submit(context.Background(), nil, fp1, nil, nil, DefaultMaxTimeSlice, false, nil)
 }
 
 func (w *Workers) Submit2(fp1 func(func()), maxTimeSlice time.Duration) *TaskHandle {
-	return w.submit(nil, fp1, nil, maxTimeSlice, false)
+	return w.submit(context.Background(), nil, fp1, nil, nil, maxTimeSlice, false, nil)
 }
 
 func (w *Workers) Submit3(fp2 func(func(func())), maxTimeSlice time.Duration, eiFlag bool) *TaskHandle {
-	return w.submit(nil, nil, fp2, maxTimeSlice, eiFlag)
+	return w.submit(context.Background(), nil, nil, fp2, nil, maxTimeSlice, eiFlag, nil)
 }
 
 func (w *Workers) SubmitX(fp0 func(), fp1 func(func()), fp2 func(func(func())), maxTimeSlice time.Duration, eiFlag bool) *TaskHandle {
-	return w.submit(fp0, fp1, fp2, maxTimeSlice, eiFlag)
+	return w.submit(context.Background(), fp0, fp1, fp2, nil, maxTimeSlice, eiFlag, nil)
+}
+
+// SubmitCtx and its variants bind the task to ctx. If ctx is done while the
+// task is still queued, the task is dropped without ever running. Once it
+// has started, the checkpoint and event call functions handed to the task
+// return ctx.Err() instead of calling the event routine, after yielding if
+// the task has overrun its time slice, and the task is expected to return as
+// soon as possible. Either way Err of the
+// returned handle reports the cancellation. opts apply to the task, see
+// TaskOption.
+func (w *Workers) SubmitCtx(ctx context.Context, fp0 func(), opts ...TaskOption) *TaskHandle {
+	return w.submit(ctx, fp0, nil, nil, nil, DefaultMaxTimeSlice, false, opts)
+}
+
+func (w *Workers) SubmitCtx1(ctx context.Context, fp1 func(func() error), opts ...TaskOption) *TaskHandle {
+	return w.submit(ctx, nil, nil, nil, wrapCheckpointFp(fp1), DefaultMaxTimeSlice, false, opts)
 }
 
-func (w *Workers) submit(fp0 func(), fp1 func(func()), fp2 func(func(func())), maxTimeSlice time.Duration, eiFlag bool) *TaskHandle {
+func (w *Workers) SubmitCtx2(ctx context.Context, fp1 func(func() error), maxTimeSlice time.Duration, opts ...TaskOption) *TaskHandle {
+	return w.submit(ctx, nil, nil, nil, wrapCheckpointFp(fp1), maxTimeSlice, false, opts)
+}
+
+func (w *Workers) SubmitCtx3(ctx context.Context, fp2 func(func(func()) error), maxTimeSlice time.Duration, eiFlag bool, opts ...TaskOption) *TaskHandle {
+	return w.submit(ctx, nil, nil, nil, fp2, maxTimeSlice, eiFlag, opts)
+}
+
+// wrapCheckpointFp adapts a task taking only a checkpoint function to the
+// fp3 form, in which a nil event routine means a plain checkpoint
+func wrapCheckpointFp(fp1 func(func() error)) func(func(func()) error) {
+	return func(call func(func()) error) {
+		fp1(func() error {
+			return call(nil)
+		})
+	}
+}
+
+func (w *Workers) submit(ctx context.Context, fp0 func(), fp1 func(func()), fp2 func(func(func())), fp3 func(func(func()) error), maxTimeSlice time.Duration, eiFlag bool, opts []TaskOption) *TaskHandle {
 	if maxTimeSlice <= 0 {
 		maxTimeSlice = DefaultMaxTimeSlice
 	}
 	task := Task{
-		validFlag: true,
-		timing:    taskSchTiming{},
-		stat:      STAT_NEW,
-		fp0:       fp0,
-		fp1:       fp1,
-		fp2:       fp2,
+		validFlag:          true,
+		eventIntensiveFlag: eiFlag,
+		timing:             taskSchTiming{},
+		stat:               STAT_NEW,
+		fp0:                fp0,
+		fp1:                fp1,
+		fp2:                fp2,
+		fp3:                fp3,
+		ctx:                ctx,
 		h: TaskHandle{
 			done:     make(chan struct{}),
 			yieldCh:  make(chan *P, 1),
 			resumeCh: make(chan *P, 1),
+			repanic:  atomic.LoadUint32(&w.repanicOnSync) != 0,
 		},
-		maxTimeSlice:     maxTimeSlice,
 		initMaxTimeSlice: maxTimeSlice,
 		w:                w,
 		pch:              make(chan *P, 1),
+		infoP:            -1,
 	}
-	if eiFlag {
-		w.runnableEventIntensiveTaskCh <- &task
-	} else {
-		w.newTaskCh <- &task
+	for _, opt := range opts {
+		opt(&task)
+	}
+	task.queuedT = time.Now()
+	task.submitT = task.queuedT
+	task.infoStatT = task.submitT.UnixNano()
+	task.id = atomic.AddUint64(&w.taskSeq, 1)
+	task.h.id = task.id
+	// set up before trackTask, as Close may drop the task from then on
+	task.traceStart()
+	if w.hooks != nil {
+		w.hooks.OnSubmit(task.hookInfo())
+	}
+	if !w.trackTask(&task) {
+		task.storeStat(STAT_END)
+		task.traceEnd(ErrWorkersClosed)
+		if w.hooks != nil {
+			w.hooks.OnEnd(task.hookInfo())
+		}
+		task.h.finish(ErrWorkersClosed)
+		return &task.h
+	}
+	if err := ctx.Err(); err != nil {
+		task.drop(err)
+		return &task.h
+	}
+	if task.deadlineExceeded(time.Now()) {
+		task.drop(ErrDeadlineExceeded)
+		return &task.h
+	}
+	task.watch()
+	select {
+	case w.newTaskCh <- &task:
+	default:
+		w.logSaturated()
+		select {
+		case w.newTaskCh <- &task:
+		case <-w.exitedCh:
+			// dropped by Close, see dropQueued
+		}
 	}
 	return &task.h
 }
@@ -788,52 +1621,195 @@ func GetGlobalWorkers() (w *Workers) {
 }
 
 func Submit(fp0 func()) *TaskHandle {
-	return GetGlobalWorkers().submit(fp0, nil, nil, DefaultMaxTimeSlice, false)
+	return GetGlobalWorkers().submit(context.Background(), fp0, nil, nil, nil, DefaultMaxTimeSlice, false, nil)
 }
 
 func Submit1(fp1 func(func())) *TaskHandle {
-	return GetGlobalWorkers().submit(nil, fp1, nil, DefaultMaxTimeSlice, false)
+	return GetGlobalWorkers().submit(context.Background(), nil, fp1, nil, nil, DefaultMaxTimeSlice, false, nil)
 }
 
 func Submit2(fp1 func(func()), maxTimeSlice time.Duration) *TaskHandle {
-	return GetGlobalWorkers().submit(nil, fp1, nil, maxTimeSlice, false)
+	return GetGlobalWorkers().submit(context.Background(), nil, fp1, nil, nil, maxTimeSlice, false, nil)
 }
 
 func Submit3(fp2 func(func(func())), maxTimeSlice time.Duration, eiFlag bool) *TaskHandle {
-	return GetGlobalWorkers().submit(nil, nil, fp2, maxTimeSlice, eiFlag)
+	return GetGlobalWorkers().submit(context.Background(), nil, nil, fp2, nil, maxTimeSlice, eiFlag, nil)
 }
 
 func SubmitX(fp0 func(), fp1 func(func()), fp2 func(func(func())), maxTimeSlice time.Duration, eiFlag bool) *TaskHandle {
-	return GetGlobalWorkers().submit(fp0, fp1, fp2, maxTimeSlice, eiFlag)
+	return GetGlobalWorkers().submit(context.Background(), fp0, fp1, fp2, nil, maxTimeSlice, eiFlag, nil)
 }
 
-/*
-func (w *Workers) Destroy() {
+func SubmitCtx(ctx context.Context, fp0 func(), opts ...TaskOption) *TaskHandle {
+	return GetGlobalWorkers().SubmitCtx(ctx, fp0, opts...)
+}
+
+func SubmitCtx1(ctx context.Context, fp1 func(func() error), opts ...TaskOption) *TaskHandle {
+	return GetGlobalWorkers().SubmitCtx1(ctx, fp1, opts...)
+}
+
+func SubmitCtx2(ctx context.Context, fp1 func(func() error), maxTimeSlice time.Duration, opts ...TaskOption) *TaskHandle {
+	return GetGlobalWorkers().SubmitCtx2(ctx, fp1, maxTimeSlice, opts...)
+}
+
+func SubmitCtx3(ctx context.Context, fp2 func(func(func()) error), maxTimeSlice time.Duration, eiFlag bool, opts ...TaskOption) *TaskHandle {
+	return GetGlobalWorkers().SubmitCtx3(ctx, fp2, maxTimeSlice, eiFlag, opts...)
+}
+
+// trackTask registers t as live, which publishes it to Close. It returns
+// false if w has been closed.
+func (w *Workers) trackTask(t *Task) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return false
+	}
+	w.tasks[t] = struct{}{}
+	return true
+}
+
+func (w *Workers) untrackTask(t *Task) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, ok := w.tasks[t]
+	assert(ok)
+	delete(w.tasks, t)
+	if w.closed && len(w.tasks) == 0 {
+		close(w.drainedCh)
+	}
+}
+
+// Close stops w from accepting new tasks, waits until every task already
+// submitted has ended and then stops the scheduler routine. Tasks submitted
+// after Close has begun end immediately with ErrWorkersClosed.
+//
+// If ctx is done before the tasks have drained, Close stops the scheduler
+// anyway and returns a *CloseError listing the tasks still pending. Those
+// which have not started yet are dropped with ErrWorkersClosed, the others
+// are abandoned and never resumed again.
+func (w *Workers) Close(ctx context.Context) error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return ErrWorkersClosed
+	}
+	w.closed = true
+	if len(w.tasks) == 0 {
+		close(w.drainedCh)
+	}
+	w.lock.Unlock()
+
+	var err error
+	select {
+	case <-w.drainedCh:
+	case <-ctx.Done():
+		err = w.pendingError(ctx.Err())
+		w.dropQueued()
+	}
 	close(w.exitCh)
+	<-w.exitedCh
+	return err
 }
-*/
 
-func GetTraceMaxPdelay() time.Duration {
-	return traceMaxPdelay
+func (w *Workers) pendingError(cause error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.tasks) == 0 {
+		// drained just in time
+		return nil
+	}
+	pending := make([]PendingTask, 0, len(w.tasks))
+	for t := range w.tasks {
+		pending = append(pending, PendingTask{
+			ID:   t.id,
+			Stat: t.loadStat(),
+		})
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].ID < pending[j].ID
+	})
+	return &CloseError{
+		Err:     cause,
+		Pending: pending,
+	}
 }
 
-func CalcAutoP() int {
-	nCPU := runtime.GOMAXPROCS(0)
-	if nCPU <= 2 {
-		return 1
+// dropQueued drops every task which has not started yet, so that their
+// handles finish
+func (w *Workers) dropQueued() {
+	w.lock.Lock()
+	var queued []*Task
+	for t := range w.tasks {
+		if t.loadStat() == STAT_NEW {
+			queued = append(queued, t)
+		}
 	}
-	if nCPU <= 5 {
-		return nCPU - 1
+	w.lock.Unlock()
+	// drop untracks the task, and loses to the scheduler if the task is
+	// being started meanwhile
+	for _, t := range queued {
+		t.drop(ErrWorkersClosed)
 	}
-	if nCPU <= 7 {
-		return nCPU - 2
+}
+
+var ErrWorkersClosed = errors.New("cpuworker: workers closed")
+
+// ErrDeadlineExceeded is the Err of a TaskHandle whose task was dropped
+// because its deadline, see WithDeadline, passed before it started.
+var ErrDeadlineExceeded = errors.New("cpuworker: task deadline exceeded")
+
+// PendingTask describes a task which had not ended when Close gave up.
+type PendingTask struct {
+	ID uint64
+	// one of STAT_NEW, STAT_RUNNING and STAT_SUSPENDED
+	Stat uint32
+}
+
+// CloseError is returned by Close when its context is done before all the
+// submitted tasks have ended.
+type CloseError struct {
+	// the error of the context passed to Close
+	Err     error
+	Pending []PendingTask
+}
+
+func (e *CloseError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cpuworker: close: %v: %d task(s) still pending:", e.Err, len(e.Pending))
+	for _, pt := range e.Pending {
+		fmt.Fprintf(&b, " %d(%s)", pt.ID, statString(pt.Stat))
 	}
-	return nCPU - (nCPU / 4)
+	return b.String()
+}
+
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+// GetTraceMaxPdelay returns the longest P handoff delay of all the Workers
+// so far, see Workers.Stats for the distribution of one Workers.
+func GetTraceMaxPdelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&traceMaxPdelay))
+}
+
+// CalcAutoP returns the number of P for the current GOMAXPROCS, see
+// DefaultReserve. Use an AutoSizer to follow the cgroup cpu limit and
+// later changes of GOMAXPROCS as well.
+func CalcAutoP() int {
+	return DefaultReserve(runtime.GOMAXPROCS(0))
+}
+
+// invariantViolation is the panic value of a failed assert, it is never
+// recovered as a PanicError of the task, see Task.run
+type invariantViolation string
+
+func (v invariantViolation) Error() string {
+	return "cpuworker: unexpected: " + string(v)
 }
 
 func assert(b bool) {
 	if b {
 	} else {
-		panic("unexpected")
+		panic(invariantViolation("invariant violated"))
 	}
 }
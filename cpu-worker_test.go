@@ -0,0 +1,496 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+func newTestWorkers(t *testing.T, opts ...Option) *Workers {
+	t.Helper()
+	w, err := NewWorkersWithOptions(append([]Option{WithP(1)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		w.Close(ctx)
+	})
+	return w
+}
+
+// waitTask fails t unless h ends in time
+func waitTask(t *testing.T, h *TaskHandle) {
+	t.Helper()
+	select {
+	case <-h.done:
+	case <-time.After(testTimeout):
+		t.Fatalf("task %d has not ended", h.ID())
+	}
+}
+
+// eventually fails t unless cond becomes true in time
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blocker is a task holding its P until released
+type blocker struct {
+	h        *TaskHandle
+	started  chan struct{}
+	released chan struct{}
+}
+
+func submitBlocker(w *Workers) *blocker {
+	b := &blocker{
+		started:  make(chan struct{}),
+		released: make(chan struct{}),
+	}
+	b.h = w.Submit(func() {
+		close(b.started)
+		<-b.released
+	})
+	return b
+}
+
+func (b *blocker) waitStarted(t *testing.T) {
+	t.Helper()
+	select {
+	case <-b.started:
+	case <-time.After(testTimeout):
+		t.Fatal("blocker has not started")
+	}
+}
+
+func (b *blocker) release() {
+	close(b.released)
+}
+
+func TestCloseDrains(t *testing.T) {
+	w, err := NewWorkersWithOptions(WithP(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ran int32
+	var hs []*TaskHandle
+	for i := 0; i < 8; i++ {
+		hs = append(hs, w.Submit1(func(ck func()) {
+			end := time.Now().Add(2 * time.Millisecond)
+			for time.Now().Before(end) {
+				ck()
+			}
+			atomic.AddInt32(&ran, 1)
+		}))
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hs {
+		if err := h.Err(); err != nil {
+			t.Fatalf("task %d: %v", h.ID(), err)
+		}
+	}
+	if n := atomic.LoadInt32(&ran); n != 8 {
+		t.Fatalf("%d tasks ran, want 8", n)
+	}
+	select {
+	case <-w.exitedCh:
+	default:
+		t.Fatal("the scheduler routine is still running")
+	}
+
+	h := w.Submit(func() {
+		t.Error("ran after Close")
+	})
+	waitTask(t, h)
+	if err := h.Err(); !errors.Is(err, ErrWorkersClosed) {
+		t.Fatalf("submitted after Close: %v", err)
+	}
+	if err := w.Close(context.Background()); !errors.Is(err, ErrWorkersClosed) {
+		t.Fatalf("closed twice: %v", err)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	w, err := NewWorkersWithOptions(WithP(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := submitBlocker(w)
+	b.waitStarted(t)
+	queued := w.Submit(func() {
+		t.Error("queued task ran")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = w.Close(ctx)
+	var cerr *CloseError
+	if !errors.As(err, &cerr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close: %v", err)
+	}
+	want := []PendingTask{
+		{ID: b.h.ID(), Stat: STAT_RUNNING},
+		{ID: queued.ID(), Stat: STAT_NEW},
+	}
+	if len(cerr.Pending) != len(want) || cerr.Pending[0] != want[0] || cerr.Pending[1] != want[1] {
+		t.Fatalf("pending %v, want %v", cerr.Pending, want)
+	}
+	// dropped rather than left hanging
+	waitTask(t, queued)
+	if err := queued.Err(); !errors.Is(err, ErrWorkersClosed) {
+		t.Fatalf("queued task: %v", err)
+	}
+	// the abandoned task still ends
+	b.release()
+	waitTask(t, b.h)
+}
+
+func TestSubmitCtxCancelQueued(t *testing.T) {
+	w := newTestWorkers(t, WithPolicy(NewEDFPolicy(NewDefaultPolicy(), 0)))
+	b := submitBlocker(w)
+	b.waitStarted(t)
+	defer b.release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := w.SubmitCtx(ctx, func() {
+		t.Error("cancelled task ran")
+	})
+	dh := w.SubmitCtx(ctx, func() {
+		t.Error("cancelled deadline task ran")
+	}, WithDeadline(time.Now().Add(time.Hour)))
+	eventually(t, "the tasks are not queued", func() bool {
+		st := w.Stats()
+		return st.QueueLen[ClassDeadline] == 1 && st.Submitted == 3
+	})
+	cancel()
+	// without waiting for the blocker
+	waitTask(t, h)
+	waitTask(t, dh)
+	for _, h := range []*TaskHandle{h, dh} {
+		if err := h.Err(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("task %d: %v", h.ID(), err)
+		}
+	}
+	eventually(t, "the cancelled tasks are still queued", func() bool {
+		st := w.Stats()
+		return st.QueueLen[ClassDeadline] == 0 && st.Dropped == 2
+	})
+
+	// already cancelled at submission
+	h = w.SubmitCtx(ctx, func() {
+		t.Error("cancelled task ran")
+	})
+	waitTask(t, h)
+	if err := h.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("submitted cancelled: %v", err)
+	}
+}
+
+func TestSubmitCtxCancelSuspended(t *testing.T) {
+	w := newTestWorkers(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	var ckErr error
+	h := w.SubmitCtx1(ctx, func(ck func() error) {
+		close(started)
+		for {
+			if ckErr = ck(); ckErr != nil {
+				return
+			}
+		}
+	})
+	<-started
+	// takes the P once the task yields, and keeps it while it is cancelled
+	b := submitBlocker(w)
+	b.waitStarted(t)
+	eventually(t, "the task is not suspended", func() bool {
+		return h.Err() == nil && w.Stats().Yielded > 0
+	})
+	cancel()
+	b.release()
+	waitTask(t, h)
+	if !errors.Is(ckErr, context.Canceled) || !errors.Is(h.Err(), context.Canceled) {
+		t.Fatalf("checkpoint returned %v, task ended with %v", ckErr, h.Err())
+	}
+}
+
+// A cancelled task ignoring the error of its checkpoints must still yield.
+func TestCancelledTaskYields(t *testing.T) {
+	for _, eventCall := range []bool{false, true} {
+		w := newTestWorkers(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		started := make(chan struct{})
+		other := make(chan struct{})
+		var otherRan bool
+		h := w.SubmitCtx3(ctx, func(call func(func()) error) {
+			close(started)
+			end := time.Now().Add(testTimeout)
+			for time.Now().Before(end) {
+				if eventCall {
+					call(func() {})
+				} else {
+					call(nil)
+				}
+				select {
+				case <-other:
+					otherRan = true
+					return
+				default:
+				}
+			}
+		}, DefaultMaxTimeSlice, false)
+		<-started
+		cancel()
+		w.Submit(func() {
+			close(other)
+		})
+		waitTask(t, h)
+		if !otherRan {
+			t.Fatalf("event call %v: the other task has not run meanwhile", eventCall)
+		}
+	}
+}
+
+func TestFuture(t *testing.T) {
+	w := newTestWorkers(t)
+	b := submitBlocker(w)
+	b.waitStarted(t)
+	f := Go(w, func(cp Checkpoint) (int, error) {
+		if err := cp.Check(); err != nil {
+			return 0, err
+		}
+		var v int
+		if err := cp.EventCall(func() {
+			v = 42
+		}); err != nil {
+			return 0, err
+		}
+		return v, nil
+	})
+	if _, ok, _ := f.TryGet(); ok {
+		t.Fatal("TryGet ok before the task has ended")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.GetCtx(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetCtx: %v", err)
+	}
+	b.release()
+	if v, err := f.Get(); v != 42 || err != nil {
+		t.Fatalf("Get: %v, %v", v, err)
+	}
+	if v, ok, err := f.TryGet(); v != 42 || !ok || err != nil {
+		t.Fatalf("TryGet: %v, %v, %v", v, ok, err)
+	}
+	select {
+	case <-f.Done():
+	default:
+		t.Fatal("Done not closed")
+	}
+
+	errFail := errors.New("fail")
+	fe := Go(w, func(cp Checkpoint) (string, error) {
+		return "partial", errFail
+	})
+	if v, err := fe.Get(); v != "partial" || !errors.Is(err, errFail) {
+		t.Fatalf("Get: %v, %v", v, err)
+	}
+
+	fc := GoCtx(ctx, w, func(cp Checkpoint) (int, error) {
+		t.Error("cancelled task ran")
+		return 1, nil
+	})
+	if _, err := fc.Get(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled: %v", err)
+	}
+
+	fp := Go(w, func(cp Checkpoint) (int, error) {
+		panic("boom")
+	})
+	var perr *PanicError
+	if _, err := fp.Get(); !errors.As(err, &perr) {
+		t.Fatalf("panicked: %v", err)
+	}
+}
+
+func TestPanicError(t *testing.T) {
+	w := newTestWorkers(t)
+	h := w.Submit(func() {
+		panic("boom")
+	})
+	waitTask(t, h)
+	var perr *PanicError
+	if !errors.As(h.Err(), &perr) || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Fatalf("Err %v", h.Err())
+	}
+	// the P has been given back
+	h = w.Submit(func() {})
+	waitTask(t, h)
+	if err := h.Err(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the P is not idle", func() bool {
+		return w.Stats().PIdle == 1
+	})
+
+	// an error value is unwrapped
+	errBoom := errors.New("boom")
+	h = w.Submit(func() {
+		panic(errBoom)
+	})
+	waitTask(t, h)
+	if !errors.Is(h.Err(), errBoom) {
+		t.Fatalf("Err %v", h.Err())
+	}
+
+	w.SetRepanicOnSync(true)
+	h = w.Submit(func() {
+		panic("boom")
+	})
+	func() {
+		defer func() {
+			if r, ok := recover().(*PanicError); !ok || r.Value != "boom" {
+				t.Fatalf("Sync re-panicked %v", r)
+			}
+		}()
+		h.Sync()
+		t.Fatal("Sync has not re-panicked")
+	}()
+}
+
+func TestDeadline(t *testing.T) {
+	w := newTestWorkers(t, WithPolicy(NewEDFPolicy(NewDefaultPolicy(), 0)))
+	b := submitBlocker(w)
+	b.waitStarted(t)
+
+	// run in the order of their deadlines, ahead of the best-effort task
+	var lock sync.Mutex
+	var order []int
+	record := func(i int) func() {
+		return func() {
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+		}
+	}
+	now := time.Now()
+	hs := []*TaskHandle{
+		w.Submit(record(3)),
+		w.SubmitCtx(context.Background(), record(2), WithDeadline(now.Add(2*time.Hour))),
+		w.SubmitCtx(context.Background(), record(1), WithDeadline(now.Add(time.Hour))),
+	}
+	// dropped while queued
+	expiring := w.SubmitCtx(context.Background(), func() {
+		t.Error("expired task ran")
+	}, WithDeadline(now.Add(10*time.Millisecond)))
+	waitTask(t, expiring)
+	if err := expiring.Err(); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatalf("expired task: %v", err)
+	}
+	eventually(t, "the expired task is still queued", func() bool {
+		return w.Stats().QueueLen[ClassDeadline] == 2
+	})
+	// expired at submission
+	expired := w.SubmitCtx(context.Background(), func() {
+		t.Error("expired task ran")
+	}, WithDeadline(now.Add(-time.Millisecond)))
+	waitTask(t, expired)
+	if err := expired.Err(); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatalf("expired task: %v", err)
+	}
+
+	b.release()
+	for _, h := range hs {
+		waitTask(t, h)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Fatalf("ran in order %v", order)
+	}
+}
+
+func TestSetMaxP(t *testing.T) {
+	w := newTestWorkers(t, WithP(1))
+	w.SetMaxP(0)
+	if p := w.GetMaxP(); p != 1 {
+		t.Fatalf("clamped to %d P, want 1", p)
+	}
+	w.SetMaxP(w.GetPLimit() + 1)
+	if p := w.GetMaxP(); p != w.GetPLimit() {
+		t.Fatalf("clamped to %d P, want %d", p, w.GetPLimit())
+	}
+
+	// grown at once
+	w.SetMaxP(3)
+	var bs []*blocker
+	for i := 0; i < 3; i++ {
+		b := submitBlocker(w)
+		b.waitStarted(t)
+		bs = append(bs, b)
+	}
+	if n := w.GetPInUse(); n != 3 {
+		t.Fatalf("%d P in use, want 3", n)
+	}
+
+	// shrunk as the tasks hand their P back
+	w.SetMaxP(1)
+	if p := w.GetMaxP(); p != 1 {
+		t.Fatalf("GetMaxP %d, want 1", p)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := w.GetPInUse(); n != 3 {
+		t.Fatalf("%d P in use while held, want 3", n)
+	}
+	for _, b := range bs {
+		b.release()
+		waitTask(t, b.h)
+	}
+	eventually(t, "the P handed back are not retired", func() bool {
+		return w.GetPInUse() == 1
+	})
+
+	// a single task runs at a time again
+	b1 := submitBlocker(w)
+	b1.waitStarted(t)
+	b2 := submitBlocker(w)
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-b2.started:
+		t.Fatal("two tasks running on a single P")
+	default:
+	}
+	b1.release()
+	b2.waitStarted(t)
+	b2.release()
+	waitTask(t, b2.h)
+}
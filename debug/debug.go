@@ -0,0 +1,445 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package debug serves the live state of cpuworker Workers over HTTP, much
+// like net/http/pprof. Importing it registers the handler under
+// /debug/cpuworker/ on http.DefaultServeMux:
+//
+//	import _ "github.com/hnes/cpuworker/debug"
+//
+// The pages are:
+//
+//	/debug/cpuworker/                the Workers and their configuration
+//	/debug/cpuworker/stats?workers=  the scheduling statistics
+//	/debug/cpuworker/p?workers=      every P and the task holding it
+//	/debug/cpuworker/runqueue?workers=  the tasks in the run queues
+//	/debug/cpuworker/tasks?workers=  every live task
+//	/debug/cpuworker/events?workers= the recent scheduling events, see
+//	                                 cpuworker.FlightRecorder
+//
+// The global Workers is listed as "global", the others must be registered
+// with Register. Every page is HTML unless ?format=json is given.
+package debug
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hnes/cpuworker"
+)
+
+const (
+	prefix = "/debug/cpuworker/"
+	// the name the global Workers is listed as
+	GlobalName = "global"
+	// the number of events shown by default
+	defaultEvents = 500
+)
+
+func init() {
+	http.HandleFunc(prefix, Index)
+}
+
+var (
+	lock    sync.Mutex
+	workers = make(map[string]*cpuworker.Workers)
+)
+
+// Register lists w as name. A Workers already registered as name is
+// replaced, registering as GlobalName hides the global Workers.
+func Register(name string, w *cpuworker.Workers) {
+	lock.Lock()
+	defer lock.Unlock()
+	workers[name] = w
+}
+
+// Unregister removes the Workers registered as name, if any.
+func Unregister(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(workers, name)
+}
+
+func lookup(name string) *cpuworker.Workers {
+	lock.Lock()
+	w, ok := workers[name]
+	lock.Unlock()
+	if !ok && name == GlobalName {
+		w = cpuworker.GetGlobalWorkers()
+	}
+	return w
+}
+
+func names() []string {
+	lock.Lock()
+	ns := make([]string, 0, len(workers)+1)
+	hasGlobal := false
+	for name := range workers {
+		ns = append(ns, name)
+		hasGlobal = hasGlobal || name == GlobalName
+	}
+	lock.Unlock()
+	if !hasGlobal && cpuworker.GetGlobalWorkers() != nil {
+		ns = append(ns, GlobalName)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// Index serves the pages under /debug/cpuworker/, it may be registered on
+// any mux at that path.
+func Index(rw http.ResponseWriter, r *http.Request) {
+	page := strings.TrimPrefix(r.URL.Path, prefix)
+	if page == "" {
+		serveIndex(rw, r)
+		return
+	}
+	serve, ok := pages[page]
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	name := r.FormValue("workers")
+	if name == "" {
+		name = GlobalName
+	}
+	w := lookup(name)
+	if w == nil {
+		http.Error(rw, fmt.Sprintf("unknown workers %q", name), http.StatusNotFound)
+		return
+	}
+	serve(rw, r, name, w)
+}
+
+var pages = map[string]func(rw http.ResponseWriter, r *http.Request, name string, w *cpuworker.Workers){
+	"stats":    serveStats,
+	"p":        serveP,
+	"runqueue": serveRunQueue,
+	"tasks":    serveTasks,
+	"events":   serveEvents,
+}
+
+// the JSON and HTML views, with the classes and stats named
+
+type workersView struct {
+	Name   string
+	Config cpuworker.WorkersConfig
+	// by the name of the class
+	QueueLen  map[string]int
+	PBusy     int
+	PIdle     int
+	Submitted uint64
+	Completed uint64
+	Dropped   uint64
+}
+
+// statsView is cpuworker.Stats taken at Time
+type statsView struct {
+	cpuworker.Stats
+	Time     time.Time
+	QueueLen map[string]int
+	P        []pView
+}
+
+type pView struct {
+	Idx        int
+	State      string
+	TaskID     uint64        `json:",omitempty"`
+	Class      string        `json:",omitempty"`
+	RunningFor time.Duration `json:",omitempty"`
+	TimeSlice  time.Duration `json:",omitempty"`
+	Preempted  bool          `json:",omitempty"`
+	LentTime   time.Duration
+}
+
+type taskView struct {
+	ID             uint64
+	Name           string            `json:",omitempty"`
+	Labels         map[string]string `json:",omitempty"`
+	Stat           string
+	P              int
+	Class          string
+	EventIntensive bool
+	EIfactor       float32
+	Age            time.Duration
+	StatAge        time.Duration
+	CPUTime        time.Duration
+}
+
+type eventView struct {
+	Time   time.Time
+	Event  string
+	P      int
+	TaskID uint64
+	Class  string
+}
+
+func newTaskViews(infos []cpuworker.TaskInfo) []taskView {
+	views := make([]taskView, len(infos))
+	for i, info := range infos {
+		views[i] = taskView{
+			ID:             info.ID,
+			Name:           info.Name,
+			Labels:         info.Labels,
+			Stat:           cpuworker.StatString(info.Stat),
+			P:              info.P,
+			Class:          info.Class.String(),
+			EventIntensive: info.EventIntensive,
+			EIfactor:       info.EIfactor,
+			Age:            info.Age,
+			StatAge:        info.StatAge,
+			CPUTime:        info.CPUTime,
+		}
+	}
+	return views
+}
+
+func serveIndex(rw http.ResponseWriter, r *http.Request) {
+	var views []workersView
+	for _, name := range names() {
+		w := lookup(name)
+		if w == nil {
+			continue
+		}
+		st := w.Stats()
+		v := workersView{
+			Name:      name,
+			Config:    w.Config(),
+			QueueLen:  namedQueueLen(&st),
+			PBusy:     st.PBusy,
+			PIdle:     st.PIdle,
+			Submitted: st.Submitted,
+			Completed: st.Completed,
+			Dropped:   st.Dropped,
+		}
+		views = append(views, v)
+	}
+	render(rw, r, "index", "", views)
+}
+
+func namedQueueLen(st *cpuworker.Stats) map[string]int {
+	lens := make(map[string]int)
+	for class, n := range st.QueueLen {
+		if n > 0 {
+			lens[cpuworker.TaskClass(class).String()] = n
+		}
+	}
+	return lens
+}
+
+func newPViews(slots []cpuworker.PSlot) []pView {
+	views := make([]pView, len(slots))
+	for i, s := range slots {
+		views[i] = pView{
+			Idx:        s.Idx,
+			State:      s.State,
+			TaskID:     s.TaskID,
+			RunningFor: s.RunningFor,
+			TimeSlice:  s.TimeSlice,
+			Preempted:  s.Preempted,
+			LentTime:   s.LentTime,
+		}
+		if s.State == cpuworker.PStateRunning || s.State == cpuworker.PStateSignalled {
+			views[i].Class = s.Class.String()
+		}
+	}
+	return views
+}
+
+func serveStats(rw http.ResponseWriter, r *http.Request, name string, w *cpuworker.Workers) {
+	st := w.Stats()
+	render(rw, r, "stats", name, statsView{
+		Stats:    st,
+		Time:     time.Now(),
+		QueueLen: namedQueueLen(&st),
+		P:        newPViews(st.P),
+	})
+}
+
+func serveP(rw http.ResponseWriter, r *http.Request, name string, w *cpuworker.Workers) {
+	render(rw, r, "p", name, newPViews(w.Stats().P))
+}
+
+func serveRunQueue(rw http.ResponseWriter, r *http.Request, name string, w *cpuworker.Workers) {
+	infos := w.RunQueue()
+	// the longest waiting first
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].StatAge > infos[j].StatAge
+	})
+	render(rw, r, "runqueue", name, newTaskViews(infos))
+}
+
+func serveTasks(rw http.ResponseWriter, r *http.Request, name string, w *cpuworker.Workers) {
+	render(rw, r, "tasks", name, newTaskViews(w.Tasks()))
+}
+
+func serveEvents(rw http.ResponseWriter, r *http.Request, name string, w *cpuworker.Workers) {
+	fr := w.FlightRecorder()
+	if fr == nil {
+		http.Error(rw, fmt.Sprintf("workers %q has no flight recorder, see cpuworker.WithFlightRecorder", name),
+			http.StatusNotFound)
+		return
+	}
+	n := defaultEvents
+	if s := r.FormValue("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(rw, fmt.Sprintf("invalid n %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	recs := fr.Records()
+	if len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+	// the latest first
+	views := make([]eventView, len(recs))
+	for i, rec := range recs {
+		views[len(recs)-1-i] = eventView{
+			Time:   rec.Time,
+			Event:  rec.Event,
+			P:      rec.P,
+			TaskID: rec.TaskID,
+			Class:  rec.Class.String(),
+		}
+	}
+	render(rw, r, "events", name, views)
+}
+
+func render(rw http.ResponseWriter, r *http.Request, page, name string, data interface{}) {
+	if r.FormValue("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.SetIndent("", "  ")
+		enc.Encode(data)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := templates.ExecuteTemplate(rw, page, struct {
+		Page    string
+		Workers string
+		Data    interface{}
+	}{page, name, data})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var templates = template.Must(template.New("").Parse(`
+{{define "header"}}<html>
+<head><title>/debug/cpuworker/{{.Page}}</title>
+<style>
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<p><a href="/debug/cpuworker/">/debug/cpuworker/</a>{{if .Workers}} &middot; {{.Workers}}:
+<a href="stats?workers={{.Workers}}">stats</a>
+<a href="p?workers={{.Workers}}">p</a>
+<a href="runqueue?workers={{.Workers}}">runqueue</a>
+<a href="tasks?workers={{.Workers}}">tasks</a>
+<a href="events?workers={{.Workers}}">events</a>{{end}}
+&middot; <a href="?{{if .Workers}}workers={{.Workers}}&amp;{{end}}format=json">json</a></p>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "tasktable"}}<table>
+<tr><th>id</th><th>name</th><th>labels</th><th>stat</th><th>for</th><th>P</th><th>class</th><th>eiFlag</th><th>eIfactor</th><th>cpu time</th><th>age</th></tr>
+{{range .}}<tr><td>{{.ID}}</td><td>{{.Name}}</td><td>{{range $k, $v := .Labels}}{{$k}}={{$v}} {{end}}</td><td>{{.Stat}}</td><td>{{.StatAge}}</td><td>{{if ge .P 0}}{{.P}}{{end}}</td><td>{{.Class}}</td><td>{{.EventIntensive}}</td><td>{{.EIfactor}}</td><td>{{.CPUTime}}</td><td>{{.Age}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+{{range .Data}}<h2>{{.Name}}</h2>
+<p><a href="stats?workers={{.Name}}">stats</a>
+<a href="p?workers={{.Name}}">p</a>
+<a href="runqueue?workers={{.Name}}">runqueue</a>
+<a href="tasks?workers={{.Name}}">tasks</a>
+<a href="events?workers={{.Name}}">events</a></p>
+<table>
+<tr><td>name</td><td>{{.Config.Name}}</td></tr>
+<tr><td>policy</td><td>{{.Config.Policy}}</td></tr>
+<tr><td>P busy / idle / in use / max / limit</td><td>{{.PBusy}} / {{.PIdle}} / {{.Config.PInUse}} / {{.Config.MaxP}} / {{.Config.PLimit}}</td></tr>
+<tr><td>max time slice</td><td>{{.Config.MaxTimeSlice}}</td></tr>
+<tr><td>queue capacity</td><td>{{.Config.QueueCapacity}}</td></tr>
+<tr><td>queued</td><td>{{range $class, $n := .QueueLen}}{{$class}}={{$n}} {{end}}</td></tr>
+<tr><td>submitted / completed / dropped</td><td>{{.Submitted}} / {{.Completed}} / {{.Dropped}}</td></tr>
+<tr><td>eIfactor threshold / cpu cutoff</td><td>{{.Config.EIThreshold}} / {{.Config.EICPUCutoff}}</td></tr>
+<tr><td>trace / runtime trace / flight recorder / pprof labels</td><td>{{.Config.Trace}} / {{.Config.RuntimeTrace}} / {{.Config.FlightRecorder}} / {{.Config.PprofLabels}}</td></tr>
+<tr><td>repanic on sync</td><td>{{.Config.RepanicOnSync}}</td></tr>
+</table>
+{{else}}<p>No Workers, see debug.Register.</p>
+{{end}}{{template "footer" .}}{{end}}
+
+{{define "p"}}{{template "header" .}}
+{{template "ptable" .Data}}
+{{template "footer" .}}{{end}}
+
+{{define "ptable"}}<table>
+<tr><th>P</th><th>state</th><th>task</th><th>class</th><th>running for</th><th>time slice</th><th>preempted</th><th>lent</th></tr>
+{{range .}}<tr><td>{{.Idx}}</td><td>{{.State}}</td><td>{{if .TaskID}}{{.TaskID}}{{end}}</td><td>{{.Class}}</td><td>{{if .TimeSlice}}{{.RunningFor}}{{end}}</td><td>{{if .TimeSlice}}{{.TimeSlice}}{{end}}</td><td>{{if .Preempted}}yes{{end}}</td><td>{{.LentTime}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{define "histogram"}}<td>{{.Count}}</td><td>{{.Quantile 0.5}}</td><td>{{.Quantile 0.9}}</td><td>{{.Quantile 0.99}}</td>{{end}}
+
+{{define "stats"}}{{template "header" .}}
+{{with .Data}}<table>
+<tr><td>P busy / idle</td><td>{{.PBusy}} / {{.PIdle}}</td></tr>
+<tr><td>queued</td><td>{{range $class, $n := .QueueLen}}{{$class}}={{$n}} {{end}}</td></tr>
+<tr><td>submitted / completed / dropped</td><td>{{.Submitted}} / {{.Completed}} / {{.Dropped}}</td></tr>
+<tr><td>yielded / event called / preemptions</td><td>{{.Yielded}} / {{.EventCalled}} / {{.Preemptions}}</td></tr>
+<tr><td>cpu time / event call time</td><td>{{.CPUTime}} / {{.EventCallTime}}</td></tr>
+</table>
+<p></p>
+<table>
+<tr><th></th><th>count</th><th>p50</th><th>p90</th><th>p99</th></tr>
+<tr><td>queue wait</td>{{template "histogram" .QueueWait}}</tr>
+<tr><td>P handoff delay</td>{{template "histogram" .PHandoffDelay}}</tr>
+<tr><td>time slice overrun</td>{{template "histogram" .TimeSliceOverrun}}</tr>
+</table>
+<p></p>
+{{template "ptable" .P}}{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "runqueue"}}{{template "header" .}}
+<p>{{len .Data}} queued, the longest waiting first.</p>
+{{template "tasktable" .Data}}
+{{template "footer" .}}{{end}}
+
+{{define "tasks"}}{{template "header" .}}
+<p>{{len .Data}} live tasks.</p>
+{{template "tasktable" .Data}}
+{{template "footer" .}}{{end}}
+
+{{define "events"}}{{template "header" .}}
+<p>The latest {{len .Data}} events first, see ?n=.</p>
+<table>
+<tr><th>time</th><th>event</th><th>P</th><th>task</th><th>class</th></tr>
+{{range .Data}}<tr><td>{{.Time.Format "15:04:05.000000"}}</td><td>{{.Event}}</td><td>{{if ge .P 0}}{{.P}}{{end}}</td><td>{{.TaskID}}</td><td>{{.Class}}</td></tr>
+{{end}}</table>
+{{template "footer" .}}{{end}}
+`))
@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"github.com/hnes/cpuworker"
+	_ "github.com/hnes/cpuworker/debug"
 )
 
 var glCrc32bs = make([]byte, 1024*256)
@@ -69,10 +70,9 @@ func handleChecksumWithCpuWorkerAndHasCheckpoint(w http.ResponseWriter, _ *http.
 
 func handleChecksumSmallTaskWithCpuWorker(w http.ResponseWriter, _ *http.Request) {
 	ts := time.Now()
-	var ck uint32
-	cpuworker.Submit(func() {
-		ck = cpuIntensiveTask(10)
-	}).Sync()
+	ck, _ := cpuworker.Go(cpuworker.GetGlobalWorkers(), func(cpuworker.Checkpoint) (uint32, error) {
+		return cpuIntensiveTask(10), nil
+	}).Get()
 	w.Write([]byte(fmt.Sprintln("crc32 (with cpuworker and small task):", ck, "time cost:", time.Now().Sub(ts))))
 }
 
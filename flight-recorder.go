@@ -0,0 +1,302 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the kinds of flightRecord, recStart to recEnd are the transitions ① to ⑤
+// of the diagram above calcEIfactor
+const (
+	recStart = iota
+	recCk
+	recEnterEventCall
+	recEndEventCall
+	recEnd
+	// the scheduler has signalled the task to yield as its time slice ran
+	// out, or on behalf of a Preempter policy
+	recPreempt
+	recPreemptEarly
+)
+
+// why the P was handed back, by the kind of the record ending the run
+var recHandedBack = map[int]string{
+	recCk:             "yield",
+	recEnterEventCall: "event call",
+	recEnd:            "end",
+}
+
+type flightRecord struct {
+	kind int
+	// the idx of the P, -1 if none
+	pIdx   int
+	taskID uint64
+	class  TaskClass
+	t      time.Time
+}
+
+// FlightRecorder keeps the latest scheduling transitions of a Workers in a
+// ring buffer, so that the timeline leading to an incident can be dumped
+// afterwards, see WriteChromeTrace. It is safe for concurrent use, and must
+// not be shared between Workers.
+type FlightRecorder struct {
+	lock sync.Mutex
+	recs []flightRecord
+	// where the next record goes, and whether recs has wrapped around
+	next    int
+	wrapped bool
+}
+
+// NewFlightRecorder returns a FlightRecorder keeping the latest size
+// transitions.
+func NewFlightRecorder(size int) *FlightRecorder {
+	assert(size > 0)
+	return &FlightRecorder{
+		recs: make([]flightRecord, size),
+	}
+}
+
+func (fr *FlightRecorder) record(kind int, pIdx int, taskID uint64, class TaskClass, t time.Time) {
+	fr.lock.Lock()
+	fr.recs[fr.next] = flightRecord{
+		kind:   kind,
+		pIdx:   pIdx,
+		taskID: taskID,
+		class:  class,
+		t:      t,
+	}
+	fr.next++
+	if fr.next == len(fr.recs) {
+		fr.next = 0
+		fr.wrapped = true
+	}
+	fr.lock.Unlock()
+}
+
+// Reset drops every record.
+func (fr *FlightRecorder) Reset() {
+	fr.lock.Lock()
+	fr.next = 0
+	fr.wrapped = false
+	fr.lock.Unlock()
+}
+
+// the names of the kinds of flightRecord, see FlightRecord.Event
+var recNames = map[int]string{
+	recStart:          "start",
+	recCk:             "yield",
+	recEnterEventCall: "enter event call",
+	recEndEventCall:   "end event call",
+	recEnd:            "end",
+	recPreempt:        "preempt",
+	recPreemptEarly:   "preempt early",
+}
+
+// FlightRecord is a scheduling transition kept by a FlightRecorder.
+type FlightRecord struct {
+	// one of "start", "yield", "enter event call", "end event call", "end",
+	// "preempt" and "preempt early"
+	Event string
+	// the idx of the P, -1 if none
+	P      int
+	TaskID uint64
+	Class  TaskClass
+	Time   time.Time
+}
+
+// Records returns the records kept by fr, oldest first.
+func (fr *FlightRecorder) Records() []FlightRecord {
+	recs := fr.snapshot()
+	out := make([]FlightRecord, len(recs))
+	for i, rec := range recs {
+		out[i] = FlightRecord{
+			Event:  recNames[rec.kind],
+			P:      rec.pIdx,
+			TaskID: rec.taskID,
+			Class:  rec.class,
+			Time:   rec.t,
+		}
+	}
+	return out
+}
+
+// snapshot returns the records in the order of their time
+func (fr *FlightRecorder) snapshot() []flightRecord {
+	fr.lock.Lock()
+	var recs []flightRecord
+	if fr.wrapped {
+		recs = append(recs, fr.recs[fr.next:]...)
+	}
+	recs = append(recs, fr.recs[:fr.next]...)
+	fr.lock.Unlock()
+	// the records of different routines may be slightly out of order
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].t.Before(recs[j].t)
+	})
+	return recs
+}
+
+// SetFlightRecorder starts recording the scheduling timeline of w into fr,
+// or stops recording if fr is nil.
+func (w *Workers) SetFlightRecorder(fr *FlightRecorder) {
+	w.recorder.Store(fr)
+}
+
+func (w *Workers) getFlightRecorder() *FlightRecorder {
+	fr, _ := w.recorder.Load().(*FlightRecorder)
+	return fr
+}
+
+// record is called by the task routine on each of its transitions
+func (t *Task) record(kind int, p *P, tm time.Time) {
+	fr := t.w.getFlightRecorder()
+	if fr == nil {
+		return
+	}
+	pIdx := -1
+	if p != nil {
+		pIdx = p.idx
+	}
+	fr.record(kind, pIdx, t.id, t.class, tm)
+}
+
+// the pid of the tracks in the Chrome trace
+const (
+	chromePidP = iota + 1
+	chromePidEventCall
+)
+
+type chromeEvent struct {
+	Name string `json:"name"`
+	Cat  string `json:"cat,omitempty"`
+	Ph   string `json:"ph"`
+	// in microseconds
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  uint64                 `json:"tid"`
+	S    string                 `json:"s,omitempty"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes the records as Chrome trace-event JSON, which can
+// be loaded into Perfetto or chrome://tracing. Each P has a track showing
+// which task held it, as which class, and why it was handed back; the event
+// routine calls of each task are on a track of their own.
+func (fr *FlightRecorder) WriteChromeTrace(out io.Writer) error {
+	recs := fr.snapshot()
+	var origin time.Time
+	if len(recs) > 0 {
+		origin = recs[0].t
+	}
+	ts := func(t time.Time) float64 {
+		return float64(t.Sub(origin)) / float64(time.Microsecond)
+	}
+
+	events := []chromeEvent{
+		{Name: "process_name", Ph: "M", Pid: chromePidP, Args: map[string]interface{}{"name": "P"}},
+		{Name: "process_name", Ph: "M", Pid: chromePidEventCall, Args: map[string]interface{}{"name": "event calls"}},
+	}
+	type running struct {
+		rec flightRecord
+		// set once the task is signalled to yield
+		preempted string
+	}
+	// by the idx of P, and by the id of task
+	runs := make(map[int]*running)
+	eventCalls := make(map[uint64]flightRecord)
+	namedP := make(map[int]bool)
+	namedTask := make(map[uint64]bool)
+	for _, rec := range recs {
+		switch rec.kind {
+		case recStart:
+			runs[rec.pIdx] = &running{rec: rec}
+			if !namedP[rec.pIdx] {
+				namedP[rec.pIdx] = true
+				events = append(events, chromeEvent{
+					Name: "thread_name", Ph: "M", Pid: chromePidP, Tid: uint64(rec.pIdx),
+					Args: map[string]interface{}{"name": fmt.Sprintf("P %d", rec.pIdx)},
+				})
+			}
+		case recPreempt, recPreemptEarly:
+			reason := "time slice"
+			if rec.kind == recPreemptEarly {
+				reason = "policy"
+			}
+			if r := runs[rec.pIdx]; r != nil && r.rec.taskID == rec.taskID {
+				r.preempted = reason
+			}
+			events = append(events, chromeEvent{
+				Name: "preempt", Cat: "preempt", Ph: "i", S: "t", Ts: ts(rec.t),
+				Pid: chromePidP, Tid: uint64(rec.pIdx),
+				Args: map[string]interface{}{"task": rec.taskID, "reason": reason},
+			})
+		case recCk, recEnterEventCall, recEnd:
+			r := runs[rec.pIdx]
+			// the start may have been overwritten in the ring buffer
+			if r != nil && r.rec.taskID == rec.taskID {
+				delete(runs, rec.pIdx)
+				args := map[string]interface{}{
+					"task":        rec.taskID,
+					"class":       r.rec.class.String(),
+					"handed back": recHandedBack[rec.kind],
+				}
+				if r.preempted != "" {
+					args["preempted"] = r.preempted
+				}
+				events = append(events, chromeEvent{
+					Name: fmt.Sprintf("task %d", rec.taskID), Cat: r.rec.class.String(), Ph: "X",
+					Ts: ts(r.rec.t), Dur: ts(rec.t) - ts(r.rec.t),
+					Pid: chromePidP, Tid: uint64(rec.pIdx), Args: args,
+				})
+			}
+			if rec.kind == recEnterEventCall {
+				eventCalls[rec.taskID] = rec
+			}
+		case recEndEventCall:
+			if enter, ok := eventCalls[rec.taskID]; ok {
+				delete(eventCalls, rec.taskID)
+				if !namedTask[rec.taskID] {
+					namedTask[rec.taskID] = true
+					events = append(events, chromeEvent{
+						Name: "thread_name", Ph: "M", Pid: chromePidEventCall, Tid: rec.taskID,
+						Args: map[string]interface{}{"name": fmt.Sprintf("task %d", rec.taskID)},
+					})
+				}
+				events = append(events, chromeEvent{
+					Name: "event call", Ph: "X", Ts: ts(enter.t), Dur: ts(rec.t) - ts(enter.t),
+					Pid: chromePidEventCall, Tid: rec.taskID,
+				})
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(out)
+	err := json.NewEncoder(bw).Encode(struct {
+		TraceEvents     []chromeEvent `json:"traceEvents"`
+		DisplayTimeUnit string        `json:"displayTimeUnit"`
+	}{events, "ns"})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"context"
+)
+
+// Checkpoint is handed to the tasks started by Go and GoCtx.
+type Checkpoint struct {
+	call func(func()) error
+}
+
+// Check gives the P back to the scheduler if the time slice of the task is
+// used up. It returns the error of the task's context once it is done.
+func (cp Checkpoint) Check() error {
+	return cp.call(nil)
+}
+
+// EventCall runs the event routine fp, e.g. blocking i/o or channel
+// operations, without holding a P. It returns the error of the task's
+// context, without calling fp, once the context is done.
+func (cp Checkpoint) EventCall(fp func()) error {
+	if fp == nil {
+		fp = func() {}
+	}
+	return cp.call(fp)
+}
+
+// Future is the typed result of a task started by Go or GoCtx.
+type Future[T any] struct {
+	h *TaskHandle
+	// written by the task routine before h.done is closed
+	val T
+	err error
+}
+
+// Go runs fp on w and returns a Future of its result.
+func Go[T any](w *Workers, fp func(cp Checkpoint) (T, error), opts ...TaskOption) *Future[T] {
+	return GoCtx(context.Background(), w, fp, opts...)
+}
+
+// GoCtx is like Go but binds the task to ctx, see SubmitCtx.
+func GoCtx[T any](ctx context.Context, w *Workers, fp func(cp Checkpoint) (T, error), opts ...TaskOption) *Future[T] {
+	f := &Future[T]{}
+	f.h = w.submit(ctx, nil, nil, nil, func(call func(func()) error) {
+		f.val, f.err = fp(Checkpoint{call: call})
+	}, DefaultMaxTimeSlice, false, opts)
+	return f
+}
+
+// Handle returns the TaskHandle of the underlying task.
+func (f *Future[T]) Handle() *TaskHandle {
+	return f.h
+}
+
+// Done returns a channel which is closed once the task has ended.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.h.done
+}
+
+// Get waits for the task to end and returns its result. The error is the
+// one returned by the task if any, otherwise that of the TaskHandle, e.g.
+// the context error when the task was cancelled before it ran or a
+// *PanicError. Like TaskHandle.Sync, it may re-panic, see SetRepanicOnSync.
+func (f *Future[T]) Get() (T, error) {
+	f.h.Sync()
+	return f.result()
+}
+
+// GetCtx is like Get but gives up waiting once ctx is done, in which case it
+// returns ctx.Err(). The task itself is not affected.
+func (f *Future[T]) GetCtx(ctx context.Context) (T, error) {
+	select {
+	case <-f.h.done:
+		f.h.maybeRepanic()
+		return f.result()
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// TryGet returns the result without waiting. ok is false if the task has not
+// ended yet.
+func (f *Future[T]) TryGet() (val T, ok bool, err error) {
+	select {
+	case <-f.h.done:
+		f.h.maybeRepanic()
+		val, err = f.result()
+		return val, true, err
+	default:
+		return val, false, nil
+	}
+}
+
+func (f *Future[T]) result() (T, error) {
+	if f.err != nil {
+		return f.val, f.err
+	}
+	return f.val, f.h.err
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"time"
+)
+
+// Hooks are called on the scheduling transitions of every task of a
+// Workers, see WithHooks. Each call is given a snapshot of the task taken
+// at the transition.
+//
+// The calls are made synchronously by the routine making the transition,
+// so they must be quick and safe for concurrent use. OnPreemptSignal is
+// called by the scheduler routine, which it must not block on, e.g. by
+// calling Workers.Stats. Embed NopHooks to implement only some of them.
+type Hooks interface {
+	// by the submitter, before the task is queued
+	OnSubmit(t TaskInfo)
+	// by the task routine, once it holds its first P
+	OnStart(t TaskInfo)
+	// by the scheduler routine, once it has signalled the task to yield
+	OnPreemptSignal(t TaskInfo)
+	// by the task routine, once it has handed its P back at a checkpoint
+	OnYield(t TaskInfo)
+	// by the task routine, once it has handed its P back to call an event
+	// routine, and once the event routine has returned
+	OnEventCallEnter(t TaskInfo)
+	OnEventCallExit(t TaskInfo)
+	// by the task routine, once it holds a P again after OnYield or
+	// OnEventCallExit
+	OnResume(t TaskInfo)
+	// once the task has ended, by its task routine, or by the routine which
+	// has dropped it before it has run; it is called before TaskHandle.Sync
+	// returns
+	OnEnd(t TaskInfo)
+}
+
+// NopHooks implements Hooks doing nothing.
+type NopHooks struct{}
+
+func (NopHooks) OnSubmit(t TaskInfo)         {}
+func (NopHooks) OnStart(t TaskInfo)          {}
+func (NopHooks) OnPreemptSignal(t TaskInfo)  {}
+func (NopHooks) OnYield(t TaskInfo)          {}
+func (NopHooks) OnEventCallEnter(t TaskInfo) {}
+func (NopHooks) OnEventCallExit(t TaskInfo)  {}
+func (NopHooks) OnResume(t TaskInfo)         {}
+func (NopHooks) OnEnd(t TaskInfo)            {}
+
+// hookInfo is the snapshot of t passed to the Hooks, which must be checked
+// for nil first so that a Workers without Hooks pays nothing for them
+func (t *Task) hookInfo() TaskInfo {
+	return t.info(time.Now())
+}
@@ -0,0 +1,294 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"math"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+const DefaultLatencyControlInterval = 100 * time.Millisecond
+const DefaultMinTimeSlice = 50 * time.Microsecond
+
+const schedLatenciesMetric = "/sched/latencies:seconds"
+
+// LatencyControllerConfig configures a LatencyController, the zero value of
+// each field but Target selects its default.
+type LatencyControllerConfig struct {
+	// the latency to hold, must > 0
+	Target time.Duration
+	// how often the latency is measured and the Workers adjusted,
+	// DefaultLatencyControlInterval by default
+	Interval time.Duration
+	// the range of Workers.SetMaxTimeSlice, DefaultMinTimeSlice and the
+	// GetMaxTimeSlice of the Workers at NewLatencyController by default
+	MinTimeSlice time.Duration
+	MaxTimeSlice time.Duration
+	// the range of Workers.SetMaxP, 1 and the GetMaxP of the Workers at
+	// NewLatencyController by default
+	MinP int
+	MaxP int
+	// the quantile of the runtime scheduling latency held to Target, 0.99
+	// by default
+	Quantile float64
+}
+
+// LatencyDecision is what a LatencyController has done in one step.
+type LatencyDecision int
+
+const (
+	DecisionHold LatencyDecision = iota
+	DecisionShrinkTimeSlice
+	DecisionGrowTimeSlice
+	DecisionShrinkP
+	DecisionGrowP
+	numLatencyDecisions
+)
+
+func (d LatencyDecision) String() string {
+	switch d {
+	case DecisionHold:
+		return "hold"
+	case DecisionShrinkTimeSlice:
+		return "shrink_time_slice"
+	case DecisionGrowTimeSlice:
+		return "grow_time_slice"
+	case DecisionShrinkP:
+		return "shrink_p"
+	case DecisionGrowP:
+		return "grow_p"
+	}
+	return "unknown"
+}
+
+// LatencyControllerStats is a snapshot of a LatencyController.
+type LatencyControllerStats struct {
+	Target time.Duration
+	// the Quantile of the runtime scheduling latency of all goroutines,
+	// measured over the last step
+	SchedLatency time.Duration
+	// the longest time a task has waited to be resumed after returning
+	// from an event routine call, measured over the last step
+	EIResumeDelay time.Duration
+	// as set by the last step
+	MaxTimeSlice time.Duration
+	MaxP         int
+	LastDecision LatencyDecision
+	// the number of steps having taken each decision
+	Decisions [numLatencyDecisions]uint64
+}
+
+// LatencyController adjusts the time slice and the number of P of a Workers
+// to hold the latency of the event intensive work to a target. Two latencies
+// are watched:
+//
+// - the runtime scheduling latency, from runtime/metrics, which covers the
+// goroutines out of the Workers, e.g. the ones serving network io, and which
+// grows when the Workers has too many P busy with cpu intensive tasks
+//
+// - the resume delay of the event intensive tasks of the Workers, which grows
+// when the time slices of the cpu intensive tasks are too long
+//
+// A step shrinks the number of P if the former is above the target, or else
+// shrinks the time slice if the latter is, growing the number of P once the
+// time slice cannot be shrunk any more. Once both are below half of the
+// target, the time slice and then the number of P are grown back step by
+// step for throughput.
+//
+// At most one LatencyController, and no AutoSizer, may adjust a Workers.
+type LatencyController struct {
+	w   *Workers
+	cfg LatencyControllerConfig
+
+	// the last sample of schedLatenciesMetric, nil if it is not supported
+	schedSample []metrics.Sample
+	lastCounts  []uint64
+	// readSchedLatency, replaced by the tests
+	schedLatency func() time.Duration
+
+	lock  sync.Mutex
+	stats LatencyControllerStats
+
+	*tickLoop
+}
+
+// NewLatencyController creates a LatencyController of w, it does nothing
+// until Start.
+func NewLatencyController(w *Workers, cfg LatencyControllerConfig) *LatencyController {
+	assert(w != nil && cfg.Target > 0)
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultLatencyControlInterval
+	}
+	if cfg.MaxTimeSlice <= 0 {
+		cfg.MaxTimeSlice = w.GetMaxTimeSlice()
+	}
+	if cfg.MinTimeSlice <= 0 {
+		cfg.MinTimeSlice = DefaultMinTimeSlice
+	}
+	if cfg.MinTimeSlice > cfg.MaxTimeSlice {
+		cfg.MinTimeSlice = cfg.MaxTimeSlice
+	}
+	if cfg.MaxP <= 0 {
+		cfg.MaxP = w.GetMaxP()
+	}
+	if cfg.MinP <= 0 {
+		cfg.MinP = 1
+	}
+	if cfg.MinP > cfg.MaxP {
+		cfg.MinP = cfg.MaxP
+	}
+	if cfg.Quantile <= 0 || cfg.Quantile > 1 {
+		cfg.Quantile = 0.99
+	}
+	c := &LatencyController{
+		w:        w,
+		cfg:      cfg,
+		tickLoop: newTickLoop(),
+	}
+	c.schedLatency = c.readSchedLatency
+	c.stats.Target = cfg.Target
+	c.stats.MaxTimeSlice = w.GetMaxTimeSlice()
+	c.stats.MaxP = w.GetMaxP()
+	sample := []metrics.Sample{{Name: schedLatenciesMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() == metrics.KindFloat64Histogram {
+		c.schedSample = sample
+		c.lastCounts = copyCounts(nil, sample[0].Value.Float64Histogram().Counts)
+	}
+	return c
+}
+
+// Start runs a step every Interval, until Stop is called or the Workers is
+// closed. It does nothing if c has been started or stopped already.
+func (c *LatencyController) Start() {
+	c.start(c.cfg.Interval, c.w.exitCh, func() {
+		c.Step()
+	}, false)
+}
+
+// Stop stops the LatencyController, if started, and waits for it; the time
+// slice and the number of P are left as they are.
+func (c *LatencyController) Stop() {
+	c.stop()
+}
+
+// Stats returns a snapshot of c.
+func (c *LatencyController) Stats() LatencyControllerStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Step measures the latencies since the last step and adjusts the Workers
+// once. It is called every Interval once started, and must not be called
+// concurrently.
+func (c *LatencyController) Step() LatencyDecision {
+	schedLatency := c.schedLatency()
+	eiDelay := c.w.swapEIResumeDelay()
+	target := c.cfg.Target
+	slice := c.w.GetMaxTimeSlice()
+	p := c.w.GetMaxP()
+
+	decision := DecisionHold
+	switch {
+	case schedLatency > target:
+		if p > c.cfg.MinP {
+			p--
+			decision = DecisionShrinkP
+		}
+	case eiDelay > target:
+		if slice > c.cfg.MinTimeSlice {
+			slice /= 2
+			if slice < c.cfg.MinTimeSlice {
+				slice = c.cfg.MinTimeSlice
+			}
+			decision = DecisionShrinkTimeSlice
+		} else if p < c.cfg.MaxP && schedLatency <= target/2 {
+			p++
+			decision = DecisionGrowP
+		}
+	case schedLatency <= target/2 && eiDelay <= target/2:
+		if slice < c.cfg.MaxTimeSlice {
+			slice += slice / 4
+			if slice > c.cfg.MaxTimeSlice {
+				slice = c.cfg.MaxTimeSlice
+			}
+			decision = DecisionGrowTimeSlice
+		} else if p < c.cfg.MaxP {
+			p++
+			decision = DecisionGrowP
+		}
+	}
+	switch decision {
+	case DecisionShrinkTimeSlice, DecisionGrowTimeSlice:
+		c.w.SetMaxTimeSlice(slice)
+	case DecisionShrinkP, DecisionGrowP:
+		c.w.SetMaxP(p)
+	}
+
+	c.lock.Lock()
+	c.stats.SchedLatency = schedLatency
+	c.stats.EIResumeDelay = eiDelay
+	c.stats.MaxTimeSlice = slice
+	c.stats.MaxP = p
+	c.stats.LastDecision = decision
+	c.stats.Decisions[decision]++
+	c.lock.Unlock()
+	return decision
+}
+
+// readSchedLatency returns the Quantile of the runtime scheduling latency
+// since the last call, 0 if unknown
+func (c *LatencyController) readSchedLatency() time.Duration {
+	if c.schedSample == nil {
+		return 0
+	}
+	metrics.Read(c.schedSample)
+	h := c.schedSample[0].Value.Float64Histogram()
+	if len(h.Counts) != len(c.lastCounts) {
+		// never happens within one process, start over anyway
+		c.lastCounts = copyCounts(c.lastCounts, h.Counts)
+		return 0
+	}
+	var total uint64
+	for i, ct := range h.Counts {
+		total += ct - c.lastCounts[i]
+	}
+	var latency time.Duration
+	if total > 0 {
+		rank := uint64(math.Ceil(float64(total) * c.cfg.Quantile))
+		var sum uint64
+		for i, ct := range h.Counts {
+			sum += ct - c.lastCounts[i]
+			if sum >= rank {
+				// Buckets[i+1] is the upper bound of Counts[i]
+				bound := h.Buckets[i+1]
+				if math.IsInf(bound, 1) {
+					bound = h.Buckets[i]
+				}
+				latency = time.Duration(bound * float64(time.Second))
+				break
+			}
+		}
+	}
+	c.lastCounts = copyCounts(c.lastCounts, h.Counts)
+	return latency
+}
+
+func copyCounts(dst, src []uint64) []uint64 {
+	return append(dst[:0], src...)
+}
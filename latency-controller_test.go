@@ -0,0 +1,129 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyControllerStep(t *testing.T) {
+	w, err := NewWorkersWithOptions(WithP(2), WithMaxTimeSlice(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close(context.Background())
+	c := NewLatencyController(w, LatencyControllerConfig{
+		Target:       time.Millisecond,
+		MinTimeSlice: 100 * time.Microsecond,
+		MaxP:         3,
+	})
+	var schedLatency time.Duration
+	c.schedLatency = func() time.Duration {
+		return schedLatency
+	}
+
+	steps := []struct {
+		schedLatency time.Duration
+		eiDelay      time.Duration
+		decision     LatencyDecision
+		slice        time.Duration
+		p            int
+	}{
+		// within the target, and the time slice is at its max already
+		{0, 700 * time.Microsecond, DecisionHold, time.Millisecond, 2},
+		// the event intensive tasks wait too long
+		{0, 5 * time.Millisecond, DecisionShrinkTimeSlice, 500 * time.Microsecond, 2},
+		{0, 5 * time.Millisecond, DecisionShrinkTimeSlice, 250 * time.Microsecond, 2},
+		{0, 5 * time.Millisecond, DecisionShrinkTimeSlice, 125 * time.Microsecond, 2},
+		{0, 5 * time.Millisecond, DecisionShrinkTimeSlice, 100 * time.Microsecond, 2},
+		// cannot shrink the time slice any more
+		{0, 5 * time.Millisecond, DecisionGrowP, 100 * time.Microsecond, 3},
+		{0, 5 * time.Millisecond, DecisionHold, 100 * time.Microsecond, 3},
+		// but not while the other goroutines are waiting
+		{700 * time.Microsecond, 5 * time.Millisecond, DecisionHold, 100 * time.Microsecond, 3},
+		// the other goroutines wait too long
+		{5 * time.Millisecond, 0, DecisionShrinkP, 100 * time.Microsecond, 2},
+		{5 * time.Millisecond, 5 * time.Millisecond, DecisionShrinkP, 100 * time.Microsecond, 1},
+		{5 * time.Millisecond, 0, DecisionHold, 100 * time.Microsecond, 1},
+		// both well below the target, grown back for throughput
+		{0, 0, DecisionGrowTimeSlice, 125 * time.Microsecond, 1},
+		{400 * time.Microsecond, 400 * time.Microsecond, DecisionGrowTimeSlice, 156250 * time.Nanosecond, 1},
+	}
+	for i, s := range steps {
+		schedLatency = s.schedLatency
+		atomic.StoreInt64(&w.eiResumeDelay, int64(s.eiDelay))
+		decision := c.Step()
+		if decision != s.decision || w.GetMaxTimeSlice() != s.slice || w.GetMaxP() != s.p {
+			t.Fatalf("step %d: got %v, time slice %v, %d P, want %v, %v, %d P", i,
+				decision, w.GetMaxTimeSlice(), w.GetMaxP(), s.decision, s.slice, s.p)
+		}
+		// consumed by the step
+		if d := w.swapEIResumeDelay(); d != 0 {
+			t.Fatalf("step %d: resume delay %v left", i, d)
+		}
+		st := c.Stats()
+		if st.LastDecision != decision || st.EIResumeDelay != s.eiDelay || st.SchedLatency != s.schedLatency ||
+			st.MaxTimeSlice != s.slice || st.MaxP != s.p {
+			t.Fatalf("step %d: stats %+v", i, st)
+		}
+	}
+
+	// grows the time slice up to its max and then the number of P
+	schedLatency = 0
+	nSteps := len(steps) + 1
+	for i := 0; i < 100 && w.GetMaxP() < 3; i++ {
+		c.Step()
+		nSteps++
+		if slice := w.GetMaxTimeSlice(); slice > time.Millisecond {
+			t.Fatalf("time slice grown to %v", slice)
+		}
+	}
+	if w.GetMaxTimeSlice() != time.Millisecond || w.GetMaxP() != 3 {
+		t.Fatalf("grown to %v, %d P", w.GetMaxTimeSlice(), w.GetMaxP())
+	}
+	if c.Step() != DecisionHold {
+		t.Fatal("grown beyond the max")
+	}
+	st := c.Stats()
+	var total uint64
+	for _, n := range st.Decisions {
+		total += n
+	}
+	if total != uint64(nSteps) || st.Decisions[DecisionShrinkP] != 2 || st.Decisions[DecisionShrinkTimeSlice] != 4 {
+		t.Fatalf("decisions %v after %d steps", st.Decisions, nSteps)
+	}
+}
+
+func TestLatencyControllerStop(t *testing.T) {
+	w, err := NewWorkersWithOptions(WithP(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close(context.Background())
+
+	// never started
+	waitStopped(t, NewLatencyController(w, LatencyControllerConfig{Target: time.Millisecond}).Stop)
+
+	c := NewLatencyController(w, LatencyControllerConfig{
+		Target:   time.Millisecond,
+		Interval: time.Millisecond,
+	})
+	c.Start()
+	c.Start()
+	waitStopped(t, c.Stop)
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// a run longer than this many times its time slice is logged as slow
+	DefaultSlowTaskFactor = 2.0
+	// at most one slow task is logged per interval
+	DefaultLogSampleInterval = time.Second
+)
+
+// workersLog logs the life of a Workers, it is nil unless set by WithLogger
+type workersLog struct {
+	logger *slog.Logger
+	level  slog.Leveler
+	// <= 0 disables the slow task logs
+	slowFactor float64
+	// 0 logs every slow task
+	sampleInterval time.Duration
+
+	// only accessed by the scheduler routine: when the last slow task was
+	// logged, and the slow tasks not logged since
+	slowLogT       time.Time
+	slowSuppressed int
+
+	// accessed atomically, when newTaskCh was found full in unix
+	// nanoseconds, 0 unless it is saturated
+	saturatedSince int64
+}
+
+func newWorkersLog(cfg *workersConfig) *workersLog {
+	if cfg.logger == nil {
+		return nil
+	}
+	level := cfg.logLevel
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	logger := cfg.logger
+	if cfg.name != "" {
+		logger = logger.With(slog.String("workers", cfg.name))
+	}
+	return &workersLog{
+		logger:         logger,
+		level:          level,
+		slowFactor:     cfg.slowTaskFactor,
+		sampleInterval: cfg.logSampleInterval,
+	}
+}
+
+func (l *workersLog) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	if level < l.level.Level() {
+		return
+	}
+	l.logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+func taskAttrs(info TaskInfo) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.Uint64("task", info.ID),
+		slog.String("stat", statString(info.Stat)),
+		slog.Int("p", info.P),
+		slog.String("class", info.Class.String()),
+	}
+	if info.Name != "" {
+		attrs = append(attrs, slog.String("name", info.Name))
+	}
+	return attrs
+}
+
+// logConfig is called once w is created
+func (w *Workers) logConfig() {
+	if w.log == nil {
+		return
+	}
+	cfg := w.Config()
+	w.log.log(slog.LevelInfo, "cpuworker: workers created",
+		slog.Int("p", cfg.MaxP),
+		slog.Int("p_limit", cfg.PLimit),
+		slog.Duration("max_time_slice", cfg.MaxTimeSlice),
+		slog.Int("queue_capacity", cfg.QueueCapacity),
+		slog.String("ei_threshold", strconv.FormatFloat(float64(cfg.EIThreshold), 'g', -1, 32)),
+		slog.Duration("ei_cpu_cutoff", cfg.EICPUCutoff),
+		slog.String("policy", cfg.Policy),
+		slog.Bool("trace", cfg.Trace),
+		slog.Bool("runtime_trace", cfg.RuntimeTrace),
+		slog.Bool("flight_recorder", cfg.FlightRecorder),
+		slog.Bool("pprof_labels", cfg.PprofLabels),
+		slog.Bool("hooks", w.hooks != nil),
+	)
+}
+
+// logSlowTask is called by the scheduler routine once the P lent to t at
+// resumeT with timeSlice is handed back at now
+func (w *Workers) logSlowTask(t *Task, pIdx int, resumeT time.Time, timeSlice time.Duration, now time.Time) {
+	l := w.log
+	if l == nil || l.slowFactor <= 0 || timeSlice <= 0 {
+		return
+	}
+	ran := now.Sub(resumeT)
+	if float64(ran) <= l.slowFactor*float64(timeSlice) {
+		return
+	}
+	if l.sampleInterval > 0 && now.Sub(l.slowLogT) < l.sampleInterval {
+		l.slowSuppressed++
+		return
+	}
+	info := t.info(now)
+	// the task may hold another P already
+	info.P = pIdx
+	attrs := append(taskAttrs(info),
+		slog.Duration("ran", ran),
+		slog.Duration("time_slice", timeSlice),
+		slog.Int("suppressed", l.slowSuppressed),
+	)
+	l.slowLogT = now
+	l.slowSuppressed = 0
+	l.log(slog.LevelWarn, "cpuworker: task overran its time slice", attrs...)
+}
+
+// logSaturated is called by a submitter which has found newTaskCh full
+func (w *Workers) logSaturated() {
+	l := w.log
+	if l == nil {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&l.saturatedSince, 0, time.Now().UnixNano()) {
+		l.log(slog.LevelWarn, "cpuworker: new task queue saturated, submitters are blocked",
+			slog.Int("queue_capacity", cap(w.newTaskCh)))
+	}
+}
+
+// logDrained is called by the scheduler routine once it has received a new
+// task, it ends the saturation episode once newTaskCh is half empty
+func (w *Workers) logDrained() {
+	l := w.log
+	if l == nil {
+		return
+	}
+	since := atomic.LoadInt64(&l.saturatedSince)
+	if since == 0 || len(w.newTaskCh) > cap(w.newTaskCh)/2 {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&l.saturatedSince, since, 0) {
+		l.log(slog.LevelInfo, "cpuworker: new task queue drained",
+			slog.Duration("saturated_for", time.Since(time.Unix(0, since))))
+	}
+}
+
+// assert is assert which logs the state of t first, see WithLogger
+func (t *Task) assert(b bool, what string) {
+	if b {
+		return
+	}
+	if l := t.w.log; l != nil {
+		attrs := append(taskAttrs(t.info(time.Now())),
+			slog.String("invariant", what))
+		l.log(slog.LevelError, "cpuworker: invariant violated", attrs...)
+	}
+	panic(invariantViolation(what))
+}
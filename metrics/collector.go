@@ -0,0 +1,250 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exposes the scheduling statistics of cpuworker Workers to
+// Prometheus, in the OpenMetrics text format.
+//
+//	c := metrics.NewCollector()
+//	c.Register("default", cpuworker.GetGlobalWorkers())
+//	http.Handle("/metrics", metrics.NewHandler(c))
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/hnes/cpuworker"
+)
+
+// Collector gathers the statistics of the registered Workers, and
+// LatencyControllers, each time it is scraped. It is safe for concurrent
+// use.
+type Collector struct {
+	lock        sync.Mutex
+	workers     map[string]*cpuworker.Workers
+	controllers map[string]*cpuworker.LatencyController
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		workers:     make(map[string]*cpuworker.Workers),
+		controllers: make(map[string]*cpuworker.LatencyController),
+	}
+}
+
+// Register adds w, its samples are labelled workers="name". A Workers
+// already registered as name is replaced.
+func (c *Collector) Register(name string, w *cpuworker.Workers) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.workers[name] = w
+}
+
+// RegisterLatencyController adds lc, its samples are labelled
+// controller="name". A LatencyController already registered as name is
+// replaced.
+func (c *Collector) RegisterLatencyController(name string, lc *cpuworker.LatencyController) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.controllers[name] = lc
+}
+
+// Unregister removes the Workers and the LatencyController registered as
+// name, if any.
+func (c *Collector) Unregister(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.workers, name)
+	delete(c.controllers, name)
+}
+
+type workersSnapshot struct {
+	name         string
+	stats        cpuworker.Stats
+	maxP         int
+	maxTimeSlice float64
+}
+
+type controllerSnapshot struct {
+	name  string
+	stats cpuworker.LatencyControllerStats
+}
+
+func (c *Collector) snapshot() ([]workersSnapshot, []controllerSnapshot) {
+	c.lock.Lock()
+	ws := make([]workersSnapshot, 0, len(c.workers))
+	for name, w := range c.workers {
+		ws = append(ws, workersSnapshot{
+			name:         name,
+			stats:        w.Stats(),
+			maxP:         w.GetMaxP(),
+			maxTimeSlice: seconds(w.GetMaxTimeSlice()),
+		})
+	}
+	cs := make([]controllerSnapshot, 0, len(c.controllers))
+	for name, lc := range c.controllers {
+		cs = append(cs, controllerSnapshot{
+			name:  name,
+			stats: lc.Stats(),
+		})
+	}
+	c.lock.Unlock()
+	sort.Slice(ws, func(i, j int) bool {
+		return ws[i].name < ws[j].name
+	})
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[i].name < cs[j].name
+	})
+	return ws, cs
+}
+
+// WriteText writes the samples of everything registered to out in the
+// OpenMetrics text format.
+func (c *Collector) WriteText(out io.Writer) error {
+	ws, cs := c.snapshot()
+	w := &writer{bw: bufio.NewWriter(out)}
+
+	gauge := func(name, unit, help string, v func(s *workersSnapshot) float64) {
+		w.family(name, "gauge", unit, help)
+		for i := range ws {
+			w.sample(name, []label{{"workers", ws[i].name}}, v(&ws[i]))
+		}
+	}
+	counter := func(name, unit, help string, v func(s *cpuworker.Stats) float64) {
+		w.family(name, "counter", unit, help)
+		for i := range ws {
+			w.sample(name+"_total", []label{{"workers", ws[i].name}}, v(&ws[i].stats))
+		}
+	}
+	histogram := func(name, help string, h func(s *cpuworker.Stats) cpuworker.Histogram) {
+		w.family(name, "histogram", "seconds", help)
+		for i := range ws {
+			w.durationHistogram(name, []label{{"workers", ws[i].name}}, h(&ws[i].stats))
+		}
+	}
+
+	w.family("cpuworker_queue_length", "gauge", "", "Number of tasks in the run queues.")
+	for i := range ws {
+		for class, n := range ws[i].stats.QueueLen {
+			w.sample("cpuworker_queue_length", []label{
+				{"workers", ws[i].name},
+				{"class", cpuworker.TaskClass(class).String()},
+			}, float64(n))
+		}
+	}
+	w.family("cpuworker_p", "gauge", "", "Number of P lent to the tasks (busy) and idle.")
+	for i := range ws {
+		w.sample("cpuworker_p", []label{{"workers", ws[i].name}, {"state", "busy"}}, float64(ws[i].stats.PBusy))
+		w.sample("cpuworker_p", []label{{"workers", ws[i].name}, {"state", "idle"}}, float64(ws[i].stats.PIdle))
+	}
+	gauge("cpuworker_p_max", "", "Number of P the Workers is sized to.", func(s *workersSnapshot) float64 {
+		return float64(s.maxP)
+	})
+	gauge("cpuworker_max_time_slice_seconds", "seconds", "Cap on the time slice of every task.", func(s *workersSnapshot) float64 {
+		return s.maxTimeSlice
+	})
+
+	counter("cpuworker_tasks_submitted", "", "Tasks received by the scheduler.", func(s *cpuworker.Stats) float64 {
+		return float64(s.Submitted)
+	})
+	counter("cpuworker_tasks_completed", "", "Tasks ended after having run.", func(s *cpuworker.Stats) float64 {
+		return float64(s.Completed)
+	})
+	counter("cpuworker_tasks_dropped", "", "Tasks dropped before having run.", func(s *cpuworker.Stats) float64 {
+		return float64(s.Dropped)
+	})
+	counter("cpuworker_yields", "", "Times a task has yielded at a checkpoint.", func(s *cpuworker.Stats) float64 {
+		return float64(s.Yielded)
+	})
+	counter("cpuworker_event_calls", "", "Times a task has returned from an event routine call.", func(s *cpuworker.Stats) float64 {
+		return float64(s.EventCalled)
+	})
+	counter("cpuworker_preemptions", "", "Times a task has been signalled to yield.", func(s *cpuworker.Stats) float64 {
+		return float64(s.Preemptions)
+	})
+	counter("cpuworker_cpu_seconds", "seconds", "Cpu time of the tasks.", func(s *cpuworker.Stats) float64 {
+		return seconds(s.CPUTime)
+	})
+	counter("cpuworker_event_call_seconds", "seconds", "Time spent by the tasks in event routine calls.", func(s *cpuworker.Stats) float64 {
+		return seconds(s.EventCallTime)
+	})
+
+	histogram("cpuworker_queue_wait_seconds", "Time from a task becoming runnable until being resumed.",
+		func(s *cpuworker.Stats) cpuworker.Histogram {
+			return s.QueueWait
+		})
+	histogram("cpuworker_p_handoff_delay_seconds", "Time from a task handing its P back until the scheduler has received it.",
+		func(s *cpuworker.Stats) cpuworker.Histogram {
+			return s.PHandoffDelay
+		})
+	histogram("cpuworker_time_slice_overrun_seconds", "Time from a task being signalled to yield until it has handed its P back.",
+		func(s *cpuworker.Stats) cpuworker.Histogram {
+			return s.TimeSliceOverrun
+		})
+	w.family("cpuworker_eifactor", "histogram", "", "Event intensive factor of the tasks.")
+	for i := range ws {
+		w.factorHistogram("cpuworker_eifactor", []label{{"workers", ws[i].name}}, ws[i].stats.EIfactor)
+	}
+
+	if len(cs) > 0 {
+		controllerGauge := func(name, help string, v func(s *cpuworker.LatencyControllerStats) float64) {
+			w.family(name, "gauge", "seconds", help)
+			for i := range cs {
+				w.sample(name, []label{{"controller", cs[i].name}}, v(&cs[i].stats))
+			}
+		}
+		controllerGauge("cpuworker_latency_target_seconds", "Latency the controller holds.",
+			func(s *cpuworker.LatencyControllerStats) float64 {
+				return seconds(s.Target)
+			})
+		controllerGauge("cpuworker_latency_sched_seconds", "Runtime scheduling latency measured by the last step.",
+			func(s *cpuworker.LatencyControllerStats) float64 {
+				return seconds(s.SchedLatency)
+			})
+		controllerGauge("cpuworker_latency_ei_resume_delay_seconds", "Event intensive resume delay measured by the last step.",
+			func(s *cpuworker.LatencyControllerStats) float64 {
+				return seconds(s.EIResumeDelay)
+			})
+		w.family("cpuworker_latency_decisions", "counter", "", "Steps of the controller by decision.")
+		for i := range cs {
+			for d, n := range cs[i].stats.Decisions {
+				w.sample("cpuworker_latency_decisions_total", []label{
+					{"controller", cs[i].name},
+					{"decision", cpuworker.LatencyDecision(d).String()},
+				}, float64(n))
+			}
+		}
+	}
+	return w.eof()
+}
+
+// NewHandler returns an http.Handler serving the samples of c.
+func NewHandler(c *Collector) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// rendered first so that a failure is reported instead of a
+		// truncated scrape
+		var buf bytes.Buffer
+		if err := c.WriteText(&buf); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", ContentType)
+		// nothing is left to be done if the scraper has gone away
+		rw.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hnes/cpuworker"
+)
+
+func TestHandler(t *testing.T) {
+	w, err := cpuworker.NewWorkersWithOptions(cpuworker.WithP(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close(context.Background())
+	w.Submit(func() {}).Sync()
+
+	c := NewCollector()
+	c.Register("plain", w)
+	c.Register("we\"ird\\name\n", w)
+	c.RegisterLatencyController("lc", cpuworker.NewLatencyController(w, cpuworker.LatencyControllerConfig{
+		Target: time.Millisecond,
+	}))
+	srv := httptest.NewServer(NewHandler(c))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+		t.Fatalf("content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+
+	if !strings.HasSuffix(text, "\n# EOF\n") || strings.Count(text, "# EOF") != 1 {
+		t.Fatalf("not terminated by a single # EOF:\n%s", text)
+	}
+	// every sample belongs to the family declared last, counters end in
+	// _total
+	types := make(map[string]string)
+	var family, typ string
+	for _, line := range strings.Split(strings.TrimSuffix(text, "# EOF\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			family, typ = fields[2], fields[3]
+			if _, ok := types[family]; ok {
+				t.Fatalf("family %s declared twice", family)
+			}
+			types[family] = typ
+			continue
+		}
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		name := line[:strings.IndexAny(line, "{ ")]
+		var suffixes []string
+		switch typ {
+		case "gauge":
+			suffixes = []string{""}
+		case "counter":
+			suffixes = []string{"_total"}
+		case "histogram":
+			suffixes = []string{"_bucket", "_count", "_sum"}
+		}
+		found := false
+		for _, s := range suffixes {
+			found = found || name == family+s
+		}
+		if !found {
+			t.Fatalf("sample %q in the %s family %s", line, typ, family)
+		}
+	}
+	for family, typ := range map[string]string{
+		"cpuworker_queue_length":            "gauge",
+		"cpuworker_p":                       "gauge",
+		"cpuworker_p_max":                   "gauge",
+		"cpuworker_tasks_submitted":         "counter",
+		"cpuworker_tasks_completed":         "counter",
+		"cpuworker_preemptions":             "counter",
+		"cpuworker_cpu_seconds":             "counter",
+		"cpuworker_queue_wait_seconds":      "histogram",
+		"cpuworker_p_handoff_delay_seconds": "histogram",
+		"cpuworker_eifactor":                "histogram",
+		"cpuworker_latency_target_seconds":  "gauge",
+		"cpuworker_latency_decisions":       "counter",
+	} {
+		if types[family] != typ {
+			t.Errorf("family %s is %q, want %q", family, types[family], typ)
+		}
+	}
+	for _, sample := range []string{
+		`cpuworker_tasks_submitted_total{workers="plain"} 1` + "\n",
+		`cpuworker_tasks_completed_total{workers="we\"ird\\name\n"} 1` + "\n",
+		`cpuworker_queue_wait_seconds_bucket{workers="plain",le="+Inf"} 1` + "\n",
+		`cpuworker_latency_target_seconds{controller="lc"} 0.001` + "\n",
+		`cpuworker_latency_decisions_total{controller="lc",decision="hold"} 0` + "\n",
+	} {
+		if !strings.Contains(text, sample) {
+			t.Errorf("no sample %q", sample)
+		}
+	}
+}
+
+type failingWriter struct {
+	n int
+}
+
+var errWrite = errors.New("write failed")
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	fw.n++
+	return 0, errWrite
+}
+
+func TestWriteTextError(t *testing.T) {
+	c := NewCollector()
+	fw := &failingWriter{}
+	if err := c.WriteText(fw); !errors.Is(err, errWrite) {
+		t.Fatalf("got %v", err)
+	}
+	if fw.n != 1 {
+		t.Fatalf("written %d times after failing", fw.n)
+	}
+}
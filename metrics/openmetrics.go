@@ -0,0 +1,136 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hnes/cpuworker"
+)
+
+// ContentType is the content type of the OpenMetrics text format.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// label is a name="value" pair of a sample
+type label struct {
+	name  string
+	value string
+}
+
+// writer writes the OpenMetrics text format, the first error is kept and
+// every write after it is a no-op
+type writer struct {
+	bw  *bufio.Writer
+	err error
+}
+
+func (w *writer) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.bw, format, args...)
+}
+
+// family writes the metadata of a metric family
+func (w *writer) family(name, typ, unit, help string) {
+	w.printf("# TYPE %s %s\n", name, typ)
+	if unit != "" {
+		w.printf("# UNIT %s %s\n", name, unit)
+	}
+	w.printf("# HELP %s %s\n", name, help)
+}
+
+func (w *writer) sample(name string, labels []label, v float64) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatFloat(v))
+}
+
+// durationHistogram writes h in seconds
+func (w *writer) durationHistogram(name string, labels []label, h cpuworker.Histogram) {
+	var cum uint64
+	for i, ct := range h.Counts {
+		cum += ct
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = formatFloat(h.Bounds[i].Seconds())
+		}
+		w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], label{"le", le}), float64(cum))
+	}
+	w.sample(name+"_count", labels, float64(h.Count))
+	w.sample(name+"_sum", labels, seconds(h.Sum))
+}
+
+func (w *writer) factorHistogram(name string, labels []label, h cpuworker.FactorHistogram) {
+	var cum uint64
+	for i, ct := range h.Counts {
+		cum += ct
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = formatFloat(h.Bounds[i])
+		}
+		w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], label{"le", le}), float64(cum))
+	}
+	w.sample(name+"_count", labels, float64(h.Count))
+	w.sample(name+"_sum", labels, h.Sum)
+}
+
+func (w *writer) eof() error {
+	w.printf("# EOF\n")
+	if w.err != nil {
+		return w.err
+	}
+	return w.bw.Flush()
+}
+
+func seconds(d time.Duration) float64 {
+	return d.Seconds()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(l.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"container/heap"
+	"time"
+)
+
+const (
+	DefaultCFSTargetLatency  = time.Millisecond * 6
+	DefaultCFSMinGranularity = time.Microsecond * 750
+)
+
+// the weight of nice 0
+const cfsNice0Weight = 1024
+
+// niceToWeight is sched_prio_to_weight of the Linux kernel, indexed by
+// nice - MinNice. Each step of nice changes the share of cpu by about 10%.
+var niceToWeight = [MaxNice - MinNice + 1]uint64{
+	/* -20 */ 88761, 71755, 56483, 46273, 36291,
+	/* -15 */ 29154, 23254, 18705, 14949, 11916,
+	/* -10 */ 9548, 7620, 6100, 4904, 3906,
+	/*  -5 */ 3121, 2501, 1991, 1586, 1277,
+	/*   0 */ 1024, 820, 655, 526, 423,
+	/*   5 */ 335, 272, 215, 172, 137,
+	/*  10 */ 110, 87, 70, 56, 45,
+	/*  15 */ 36, 29, 23, 18, 15,
+}
+
+// CFSConfig configures the policy returned by NewCFSPolicy. Zero fields
+// take the defaults.
+type CFSConfig struct {
+	// the period in which every runnable task should run once, it is
+	// stretched to MinGranularity * the number of runnable tasks when there
+	// are too many of them
+	TargetLatency time.Duration
+	// the smallest time slice a task gets
+	MinGranularity time.Duration
+}
+
+type cfsEntity struct {
+	t      *Task
+	weight uint64
+	// virtual runtime in nanoseconds, the cpu time scaled by
+	// cfsNice0Weight / weight
+	vruntime int64
+	// breaks ties of vruntime in FIFO order
+	seq uint64
+	// index in cfsPolicy.rq, -1 if not queued
+	idx int
+}
+
+type cfsRunQueue []*cfsEntity
+
+func (rq cfsRunQueue) Len() int { return len(rq) }
+
+func (rq cfsRunQueue) Less(i, j int) bool {
+	if rq[i].vruntime != rq[j].vruntime {
+		return rq[i].vruntime < rq[j].vruntime
+	}
+	return rq[i].seq < rq[j].seq
+}
+
+func (rq cfsRunQueue) Swap(i, j int) {
+	rq[i], rq[j] = rq[j], rq[i]
+	rq[i].idx = i
+	rq[j].idx = j
+}
+
+func (rq *cfsRunQueue) Push(x interface{}) {
+	se := x.(*cfsEntity)
+	se.idx = len(*rq)
+	*rq = append(*rq, se)
+}
+
+func (rq *cfsRunQueue) Pop() interface{} {
+	old := *rq
+	n := len(old)
+	se := old[n-1]
+	old[n-1] = nil
+	se.idx = -1
+	*rq = old[0 : n-1]
+	return se
+}
+
+// cfsPolicy is a policy modeled on the Completely Fair Scheduler of Linux.
+//
+// Every task accumulates a virtual runtime, which is its cpu time weighted
+// by its nice value, and the task with the smallest virtual runtime is
+// picked first. The time slice of a task is its weighted share of
+// TargetLatency, but never less than MinGranularity.
+type cfsPolicy struct {
+	cfg CFSConfig
+	rq  cfsRunQueue
+	seq uint64
+	// sum of the weights of the queued tasks
+	queuedWeight uint64
+	// monotonic, the vruntime new and waking tasks are placed relative to
+	minVruntime int64
+}
+
+// NewCFSPolicy returns a CFS-like policy. The per-task time slice requested
+// at submission is ignored by it. NewWorkersWithOptions raises the cap on
+// the time slices to cfg.TargetLatency unless WithMaxTimeSlice is given, in
+// which case it must not be less than cfg.TargetLatency.
+func NewCFSPolicy(cfg CFSConfig) Policy {
+	if cfg.TargetLatency <= 0 {
+		cfg.TargetLatency = DefaultCFSTargetLatency
+	}
+	if cfg.MinGranularity <= 0 {
+		cfg.MinGranularity = DefaultCFSMinGranularity
+	}
+	if cfg.MinGranularity > cfg.TargetLatency {
+		cfg.MinGranularity = cfg.TargetLatency
+	}
+	return &cfsPolicy{
+		cfg: cfg,
+		rq:  make(cfsRunQueue, 0, 128),
+	}
+}
+
+func (cp *cfsPolicy) entity(t *Task) *cfsEntity {
+	se, _ := t.PolicyData().(*cfsEntity)
+	if se == nil {
+		se = &cfsEntity{
+			t:      t,
+			weight: niceToWeight[t.Nice()-MinNice],
+			idx:    -1,
+		}
+		t.SetPolicyData(se)
+	}
+	return se
+}
+
+// account charges the last run of t to its vruntime
+func (cp *cfsPolicy) account(se *cfsEntity) {
+	d := se.t.LastRunDuration()
+	if d > 0 {
+		se.vruntime += int64(d) * cfsNice0Weight / int64(se.weight)
+	}
+}
+
+func (cp *cfsPolicy) enqueue(se *cfsEntity) {
+	assert(se.idx < 0)
+	cp.seq++
+	se.seq = cp.seq
+	cp.queuedWeight += se.weight
+	heap.Push(&cp.rq, se)
+}
+
+func (cp *cfsPolicy) Enqueue(t *Task, now time.Time) {
+	se := cp.entity(t)
+	// a new task starts at the current minimum so that it neither
+	// starves the others nor gets starved
+	se.vruntime = cp.minVruntime
+	cp.enqueue(se)
+}
+
+func (cp *cfsPolicy) OnYield(t *Task, now time.Time) {
+	se := cp.entity(t)
+	cp.account(se)
+	cp.enqueue(se)
+}
+
+func (cp *cfsPolicy) OnEventCallReturn(t *Task, now time.Time) {
+	se := cp.entity(t)
+	cp.account(se)
+	// a task waking up from an event routine gets at most half of a
+	// TargetLatency of credit for the time it has been off cpu
+	credit := cp.minVruntime - int64(cp.cfg.TargetLatency/2)
+	if se.vruntime < credit {
+		se.vruntime = credit
+	}
+	cp.enqueue(se)
+}
+
+func (cp *cfsPolicy) PickNext(now time.Time) (*Task, TaskClass) {
+	if cp.rq.Len() == 0 {
+		return nil, ClassNone
+	}
+	se := heap.Pop(&cp.rq).(*cfsEntity)
+	cp.queuedWeight -= se.weight
+	if se.vruntime > cp.minVruntime {
+		cp.minVruntime = se.vruntime
+	}
+	return se.t, classOf(se.t)
+}
+
+func (cp *cfsPolicy) Len() int {
+	return cp.rq.Len()
+}
+
+// WalkQueue implements QueueWalker.
+func (cp *cfsPolicy) WalkQueue(fn func(t *Task)) {
+	for _, se := range cp.rq {
+		fn(se.t)
+	}
+}
+
+// QueueLens implements QueueLener.
+func (cp *cfsPolicy) QueueLens(lens []int) {
+	for _, se := range cp.rq {
+		lens[classOf(se.t)]++
+	}
+}
+
+func (cp *cfsPolicy) TimeSliceFor(t *Task) time.Duration {
+	se := cp.entity(t)
+	nr := time.Duration(cp.rq.Len() + 1)
+	period := cp.cfg.TargetLatency
+	if period < cp.cfg.MinGranularity*nr {
+		period = cp.cfg.MinGranularity * nr
+	}
+	totalWeight := cp.queuedWeight + se.weight
+	slice := time.Duration(uint64(period) * se.weight / totalWeight)
+	if slice < cp.cfg.MinGranularity {
+		slice = cp.cfg.MinGranularity
+	}
+	return slice
+}
+
+// capTimeSlice implements sliceCapper, a slice is a share of
+// TargetLatency.
+func (cp *cfsPolicy) capTimeSlice() time.Duration {
+	return cp.cfg.TargetLatency
+}
+
+func (cp *cfsPolicy) OnEnd(t *Task) {
+	se, _ := t.PolicyData().(*cfsEntity)
+	if se == nil {
+		return
+	}
+	assert(se.idx < 0)
+	t.SetPolicyData(nil)
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"time"
+)
+
+const (
+	DefaultAgingInterval = time.Millisecond * 20
+	DefaultMaxQueueWait  = time.Millisecond * 200
+)
+
+// DefaultPolicyConfig configures the policy returned by
+// NewDefaultPolicyWithConfig.
+type DefaultPolicyConfig struct {
+	// a queued task is boosted by one priority level per AgingInterval it
+	// has waited, 0 means DefaultAgingInterval, negative disables aging
+	AgingInterval time.Duration
+	// new and cpu intensive tasks which have waited longer than this are
+	// picked before anything else, 0 means DefaultMaxQueueWait, negative
+	// disables the bound
+	MaxQueueWait time.Duration
+	// the time slice of event intensive and new tasks, 0 means
+	// MaxEITaskTimeslice and MaxNewTaskTimeslice respectively
+	EITaskTimeSlice  time.Duration
+	NewTaskTimeSlice time.Duration
+}
+
+// defaultPolicy is the original scheduling policy of cpuworker.
+//
+// Tasks are picked by priority:
+//
+//	event intensive > new > cpu intensive
+//
+// Event intensive tasks are ordered by their eIfactor, the others are FIFO.
+// Event intensive and new tasks run with a shorter time slice, see
+// DefaultPolicyConfig.EITaskTimeSlice and NewTaskTimeSlice.
+//
+// To keep a sustained event intensive load from starving the others, the
+// head of each queue is boosted by one priority level per AgingInterval it
+// has waited, and the head of the new or cpu intensive queue which has
+// waited longer than MaxQueueWait is picked unconditionally.
+type defaultPolicy struct {
+	cfg      DefaultPolicyConfig
+	eiTaskPq *prioTaskQueue
+	newTaskQ taskFifo
+	cpuTaskQ taskFifo
+}
+
+// NewDefaultPolicy returns the policy used by NewWorkers.
+func NewDefaultPolicy() Policy {
+	return NewDefaultPolicyWithConfig(DefaultPolicyConfig{})
+}
+
+func NewDefaultPolicyWithConfig(cfg DefaultPolicyConfig) Policy {
+	if cfg.AgingInterval == 0 {
+		cfg.AgingInterval = DefaultAgingInterval
+	}
+	if cfg.MaxQueueWait == 0 {
+		cfg.MaxQueueWait = DefaultMaxQueueWait
+	}
+	if cfg.EITaskTimeSlice <= 0 {
+		cfg.EITaskTimeSlice = MaxEITaskTimeslice
+	}
+	if cfg.NewTaskTimeSlice <= 0 {
+		cfg.NewTaskTimeSlice = MaxNewTaskTimeslice
+	}
+	return &defaultPolicy{
+		cfg:      cfg,
+		eiTaskPq: newPrioTaskQueue(),
+	}
+}
+
+func (dp *defaultPolicy) Enqueue(t *Task, now time.Time) {
+	if t.EventIntensive() {
+		dp.eiTaskPq.Push(t, t.EIfactor())
+	} else {
+		dp.newTaskQ.Push(t)
+	}
+}
+
+func (dp *defaultPolicy) OnYield(t *Task, now time.Time) {
+	dp.requeue(t)
+}
+
+func (dp *defaultPolicy) OnEventCallReturn(t *Task, now time.Time) {
+	dp.requeue(t)
+}
+
+func (dp *defaultPolicy) requeue(t *Task) {
+	if eiFactorBt0(t.EIfactor()) {
+		dp.eiTaskPq.Push(t, t.EIfactor())
+	} else {
+		dp.cpuTaskQ.Push(t)
+	}
+}
+
+func (dp *defaultPolicy) PickNext(now time.Time) (*Task, TaskClass) {
+	// base priority:
+	//   eIQ > newQ > cIQ
+	var heads [3]*Task
+	classes := [3]TaskClass{ClassCPUIntensive, ClassNew, ClassEventIntensive}
+	if dp.cpuTaskQ.Len() > 0 {
+		heads[0] = dp.cpuTaskQ.Peek()
+	}
+	if dp.newTaskQ.Len() > 0 {
+		heads[1] = dp.newTaskQ.Peek()
+	}
+	if dp.eiTaskPq.Len() > 0 {
+		heads[2] = dp.eiTaskPq.PeekTopest().t
+	}
+	best := -1
+	if dp.cfg.MaxQueueWait > 0 {
+		// the bound on the wait of new and cpu intensive tasks
+		var longestWait time.Duration
+		for i := 0; i < 2; i++ {
+			if heads[i] == nil {
+				continue
+			}
+			wait := now.Sub(heads[i].QueuedAt())
+			if wait >= dp.cfg.MaxQueueWait && wait > longestWait {
+				longestWait = wait
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		var bestPrio int64
+		for i := len(heads) - 1; i >= 0; i-- {
+			if heads[i] == nil {
+				continue
+			}
+			prio := int64(i)
+			if dp.cfg.AgingInterval > 0 {
+				prio += int64(now.Sub(heads[i].QueuedAt()) / dp.cfg.AgingInterval)
+			}
+			// ties go to the higher base priority
+			if best < 0 || prio > bestPrio {
+				best = i
+				bestPrio = prio
+			}
+		}
+	}
+	switch best {
+	case 0:
+		return dp.cpuTaskQ.Pop(), classes[best]
+	case 1:
+		return dp.newTaskQ.Pop(), classes[best]
+	case 2:
+		return dp.eiTaskPq.Pop().t, classes[best]
+	}
+	return nil, ClassNone
+}
+
+func (dp *defaultPolicy) Len() int {
+	return dp.eiTaskPq.Len() + dp.newTaskQ.Len() + dp.cpuTaskQ.Len()
+}
+
+// WalkQueue implements QueueWalker.
+func (dp *defaultPolicy) WalkQueue(fn func(t *Task)) {
+	dp.eiTaskPq.Walk(fn)
+	for _, t := range dp.newTaskQ.Tasks() {
+		fn(t)
+	}
+	for _, t := range dp.cpuTaskQ.Tasks() {
+		fn(t)
+	}
+}
+
+// QueueLens implements QueueLener.
+func (dp *defaultPolicy) QueueLens(lens []int) {
+	lens[ClassEventIntensive] += dp.eiTaskPq.Len()
+	lens[ClassNew] += dp.newTaskQ.Len()
+	lens[ClassCPUIntensive] += dp.cpuTaskQ.Len()
+}
+
+func (dp *defaultPolicy) TimeSliceFor(t *Task) time.Duration {
+	slice := t.MaxTimeSlice()
+	switch t.Class() {
+	case ClassEventIntensive:
+		if slice > dp.cfg.EITaskTimeSlice {
+			slice = dp.cfg.EITaskTimeSlice
+		}
+	case ClassNew:
+		if slice > dp.cfg.NewTaskTimeSlice {
+			slice = dp.cfg.NewTaskTimeSlice
+		}
+	}
+	return slice
+}
+
+func (dp *defaultPolicy) OnEnd(t *Task) {
+}
+
+// Remove implements Remover. Only event intensive tasks are removed, the
+// ones in the FIFO queues are discarded once picked.
+func (dp *defaultPolicy) Remove(t *Task) bool {
+	return dp.eiTaskPq.Remove(t)
+}
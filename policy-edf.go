@@ -0,0 +1,228 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"container/heap"
+	"time"
+)
+
+// DefaultEDFPreemptSlack is the default slack of NewEDFPolicy.
+const DefaultEDFPreemptSlack = time.Millisecond
+
+type edfEntry struct {
+	t        *Task
+	deadline time.Time
+	// breaks ties of deadline in FIFO order
+	seq uint64
+	// the index in edfQueue, maintained by its heap.Interface methods
+	idx int
+}
+
+type edfQueue []*edfEntry
+
+func (q edfQueue) Len() int { return len(q) }
+
+func (q edfQueue) Less(i, j int) bool {
+	if !q[i].deadline.Equal(q[j].deadline) {
+		return q[i].deadline.Before(q[j].deadline)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q edfQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].idx = i
+	q[j].idx = j
+}
+
+func (q *edfQueue) Push(x interface{}) {
+	e := x.(*edfEntry)
+	e.idx = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *edfQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	x.idx = -1
+	*q = old[0 : n-1]
+	return x
+}
+
+// edfPolicy runs the tasks having a deadline, see WithDeadline, in
+// earliest-deadline-first order and ahead of every other task, which are
+// left to the best-effort policy.
+//
+// It is also a Preempter: once the earliest deadline of the queued tasks is
+// closer than slack, a running best-effort task is preempted to make room.
+type edfPolicy struct {
+	bestEffort Policy
+	slack      time.Duration
+	q          edfQueue
+	seq        uint64
+	// every queued task to its entry in q, see Remove
+	entries map[*Task]*edfEntry
+}
+
+// NewEDFPolicy returns an earliest-deadline-first policy on top of
+// bestEffort, which must not be used anywhere else. If slack <= 0,
+// DefaultEDFPreemptSlack is used.
+func NewEDFPolicy(bestEffort Policy, slack time.Duration) Policy {
+	assert(bestEffort != nil)
+	if slack <= 0 {
+		slack = DefaultEDFPreemptSlack
+	}
+	return &edfPolicy{
+		bestEffort: bestEffort,
+		slack:      slack,
+		entries:    make(map[*Task]*edfEntry),
+	}
+}
+
+func (ep *edfPolicy) push(t *Task, deadline time.Time) {
+	_, ok := ep.entries[t]
+	assert(!ok)
+	ep.seq++
+	e := &edfEntry{
+		t:        t,
+		deadline: deadline,
+		seq:      ep.seq,
+	}
+	heap.Push(&ep.q, e)
+	ep.entries[t] = e
+}
+
+func (ep *edfPolicy) Enqueue(t *Task, now time.Time) {
+	if deadline, ok := t.Deadline(); ok {
+		ep.push(t, deadline)
+	} else {
+		ep.bestEffort.Enqueue(t, now)
+	}
+}
+
+func (ep *edfPolicy) OnYield(t *Task, now time.Time) {
+	if deadline, ok := t.Deadline(); ok {
+		ep.push(t, deadline)
+	} else {
+		ep.bestEffort.OnYield(t, now)
+	}
+}
+
+func (ep *edfPolicy) OnEventCallReturn(t *Task, now time.Time) {
+	if deadline, ok := t.Deadline(); ok {
+		ep.push(t, deadline)
+	} else {
+		ep.bestEffort.OnEventCallReturn(t, now)
+	}
+}
+
+func (ep *edfPolicy) PickNext(now time.Time) (*Task, TaskClass) {
+	if ep.q.Len() > 0 {
+		e := heap.Pop(&ep.q).(*edfEntry)
+		delete(ep.entries, e.t)
+		return e.t, ClassDeadline
+	}
+	return ep.bestEffort.PickNext(now)
+}
+
+func (ep *edfPolicy) Len() int {
+	return ep.q.Len() + ep.bestEffort.Len()
+}
+
+// WalkQueue implements QueueWalker.
+func (ep *edfPolicy) WalkQueue(fn func(t *Task)) {
+	for _, e := range ep.q {
+		fn(e.t)
+	}
+	if qw, ok := ep.bestEffort.(QueueWalker); ok {
+		qw.WalkQueue(fn)
+	}
+}
+
+// QueueLens implements QueueLener.
+func (ep *edfPolicy) QueueLens(lens []int) {
+	lens[ClassDeadline] += ep.q.Len()
+	if ql, ok := ep.bestEffort.(QueueLener); ok {
+		ql.QueueLens(lens)
+	} else {
+		lens[ClassNone] += ep.bestEffort.Len()
+	}
+}
+
+func (ep *edfPolicy) TimeSliceFor(t *Task) time.Duration {
+	if t.Class() == ClassDeadline {
+		return t.MaxTimeSlice()
+	}
+	return ep.bestEffort.TimeSliceFor(t)
+}
+
+// capTimeSlice implements sliceCapper on behalf of the best-effort policy.
+func (ep *edfPolicy) capTimeSlice() time.Duration {
+	if sc, ok := ep.bestEffort.(sliceCapper); ok {
+		return sc.capTimeSlice()
+	}
+	return 0
+}
+
+func (ep *edfPolicy) OnEnd(t *Task) {
+	if _, ok := t.Deadline(); !ok {
+		ep.bestEffort.OnEnd(t)
+	}
+}
+
+// Remove implements Remover. The best-effort tasks are left to the
+// best-effort policy.
+func (ep *edfPolicy) Remove(t *Task) bool {
+	if _, ok := t.Deadline(); ok {
+		e, ok := ep.entries[t]
+		if !ok {
+			return false
+		}
+		heap.Remove(&ep.q, e.idx)
+		delete(ep.entries, t)
+		return true
+	}
+	if remover, ok := ep.bestEffort.(Remover); ok {
+		return remover.Remove(t)
+	}
+	return false
+}
+
+// PreemptAt implements Preempter. A queued task is at risk once its
+// deadline is closer than slack.
+func (ep *edfPolicy) PreemptAt(now time.Time) (at time.Time, n int) {
+	if ep.q.Len() == 0 {
+		return at, 0
+	}
+	at = ep.q[0].deadline.Add(-ep.slack)
+	if at.After(now) {
+		return at, 1
+	}
+	// every queued task which is already at risk
+	for _, e := range ep.q {
+		if !e.deadline.Add(-ep.slack).After(now) {
+			n++
+		}
+	}
+	return at, n
+}
+
+// Preemptible implements Preempter, only best-effort tasks are preempted.
+func (ep *edfPolicy) Preemptible(t *Task) bool {
+	return t.Class() != ClassDeadline
+}
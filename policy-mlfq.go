@@ -0,0 +1,207 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"time"
+)
+
+// DefaultMLFQLevelTimeSlices are the time slices of the levels of the policy
+// from NewMLFQPolicy when MLFQConfig.LevelTimeSlices is empty.
+var DefaultMLFQLevelTimeSlices = []time.Duration{
+	time.Microsecond * 100,
+	time.Microsecond * 200,
+	time.Microsecond * 500,
+	time.Microsecond * 1000,
+}
+
+const DefaultMLFQBoostInterval = time.Millisecond * 100
+
+// MLFQConfig configures the policy returned by NewMLFQPolicy.
+type MLFQConfig struct {
+	// the time slice of each level, starting from level 0 which has the
+	// highest priority; the number of levels is its length
+	// non-positive slices are replaced by DefaultMaxTimeSlice
+	LevelTimeSlices []time.Duration
+	// every task is moved back to level 0 once per BoostInterval so that
+	// the tasks at the lower levels would not starve
+	// 0 means DefaultMLFQBoostInterval, negative disables the boost
+	BoostInterval time.Duration
+}
+
+type mlfqEntity struct {
+	level int
+	// the mlfqPolicy.boostEpoch it has seen
+	boostEpoch uint64
+}
+
+// mlfqPolicy is a multi-level feedback queue policy.
+//
+// A task always enters at level 0. One which uses up its time slice, and
+// so yields at a checkpoint, moves down a level, and one which gives up its
+// P for an event routine before using half of its time slice moves up a
+// level. Levels are picked strictly by priority, FIFO within a level, and
+// every BoostInterval all the tasks are moved back to level 0.
+type mlfqPolicy struct {
+	slices        []time.Duration
+	boostInterval time.Duration
+	qs            []taskFifo
+	n             int
+	lastBoostT    time.Time
+	boostEpoch    uint64
+}
+
+// NewMLFQPolicy returns a multi-level feedback queue policy. The time slice
+// of a task is that of its level, but never more than the one requested at
+// submission.
+func NewMLFQPolicy(cfg MLFQConfig) Policy {
+	slices := cfg.LevelTimeSlices
+	if len(slices) == 0 {
+		slices = DefaultMLFQLevelTimeSlices
+	}
+	slices = append([]time.Duration(nil), slices...)
+	for i, s := range slices {
+		if s <= 0 {
+			slices[i] = DefaultMaxTimeSlice
+		}
+	}
+	boostInterval := cfg.BoostInterval
+	if boostInterval == 0 {
+		boostInterval = DefaultMLFQBoostInterval
+	}
+	return &mlfqPolicy{
+		slices:        slices,
+		boostInterval: boostInterval,
+		qs:            make([]taskFifo, len(slices)),
+	}
+}
+
+func (mp *mlfqPolicy) entity(t *Task) *mlfqEntity {
+	se, _ := t.PolicyData().(*mlfqEntity)
+	if se == nil {
+		se = &mlfqEntity{
+			boostEpoch: mp.boostEpoch,
+		}
+		t.SetPolicyData(se)
+	}
+	if se.boostEpoch != mp.boostEpoch {
+		// it was running during a boost
+		se.level = 0
+		se.boostEpoch = mp.boostEpoch
+	}
+	return se
+}
+
+// tryBoost moves every queued task to level 0 once BoostInterval has passed
+func (mp *mlfqPolicy) tryBoost(now time.Time) {
+	if mp.boostInterval < 0 {
+		return
+	}
+	if mp.lastBoostT.IsZero() {
+		mp.lastBoostT = now
+		return
+	}
+	if now.Sub(mp.lastBoostT) < mp.boostInterval {
+		return
+	}
+	mp.lastBoostT = now
+	mp.boostEpoch++
+	for level := 1; level < len(mp.qs); level++ {
+		q := &mp.qs[level]
+		for q.Len() > 0 {
+			t := q.Pop()
+			mp.entity(t)
+			mp.qs[0].Push(t)
+		}
+	}
+}
+
+func (mp *mlfqPolicy) push(t *Task, se *mlfqEntity) {
+	mp.qs[se.level].Push(t)
+	mp.n++
+}
+
+func (mp *mlfqPolicy) Enqueue(t *Task, now time.Time) {
+	mp.tryBoost(now)
+	se := mp.entity(t)
+	se.level = 0
+	mp.push(t, se)
+}
+
+func (mp *mlfqPolicy) OnYield(t *Task, now time.Time) {
+	mp.tryBoost(now)
+	se := mp.entity(t)
+	if se.level < len(mp.slices)-1 {
+		se.level++
+	}
+	mp.push(t, se)
+}
+
+func (mp *mlfqPolicy) OnEventCallReturn(t *Task, now time.Time) {
+	mp.tryBoost(now)
+	se := mp.entity(t)
+	if se.level > 0 && t.LastRunDuration() < mp.slices[se.level]/2 {
+		se.level--
+	}
+	mp.push(t, se)
+}
+
+func (mp *mlfqPolicy) PickNext(now time.Time) (*Task, TaskClass) {
+	mp.tryBoost(now)
+	for level := range mp.qs {
+		q := &mp.qs[level]
+		if q.Len() == 0 {
+			continue
+		}
+		t := q.Pop()
+		mp.n--
+		return t, classOf(t)
+	}
+	return nil, ClassNone
+}
+
+func (mp *mlfqPolicy) Len() int {
+	return mp.n
+}
+
+// WalkQueue implements QueueWalker.
+func (mp *mlfqPolicy) WalkQueue(fn func(t *Task)) {
+	for level := range mp.qs {
+		for _, t := range mp.qs[level].Tasks() {
+			fn(t)
+		}
+	}
+}
+
+// QueueLens implements QueueLener.
+func (mp *mlfqPolicy) QueueLens(lens []int) {
+	for level := range mp.qs {
+		for _, t := range mp.qs[level].Tasks() {
+			lens[classOf(t)]++
+		}
+	}
+}
+
+func (mp *mlfqPolicy) TimeSliceFor(t *Task) time.Duration {
+	slice := mp.slices[mp.entity(t).level]
+	if slice > t.MaxTimeSlice() {
+		slice = t.MaxTimeSlice()
+	}
+	return slice
+}
+
+func (mp *mlfqPolicy) OnEnd(t *Task) {
+	t.SetPolicyData(nil)
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"time"
+)
+
+// Policy decides which runnable task runs next and for how long.
+//
+// All the methods are called from the scheduler routine of the Workers the
+// policy belongs to, so an implementation needs no locking of its own, but
+// it must not be shared between Workers. The *Task passed in must be treated
+// as opaque apart from its exported accessors.
+type Policy interface {
+	// Enqueue queues a newly submitted task.
+	Enqueue(t *Task, now time.Time)
+	// OnYield queues again a task which has given its P back at a
+	// checkpoint because its time slice was used up.
+	OnYield(t *Task, now time.Time)
+	// OnEventCallReturn queues again a task which has returned from an
+	// event routine.
+	OnEventCallReturn(t *Task, now time.Time)
+	// PickNext removes the next task to run from the queues and returns it
+	// together with the class it runs as. It is only called when Len() > 0
+	// and a P is available.
+	PickNext(now time.Time) (*Task, TaskClass)
+	// Len returns the number of queued tasks.
+	Len() int
+	// TimeSliceFor returns the time slice of t which has just been picked.
+	// The Workers caps it with its maxTimeSlice, and a non-positive value
+	// means the cap itself.
+	TimeSliceFor(t *Task) time.Duration
+	// OnEnd is called once t has ended, or has been picked after it was
+	// dropped because of a cancellation. t is not queued at that moment.
+	OnEnd(t *Task)
+}
+
+// Preempter is an optional interface of a Policy. While all the P are busy,
+// the scheduler asks it whether a running task should be preempted before
+// its time slice is used up, in favour of a queued one.
+type Preempter interface {
+	// PreemptAt returns the time at which n running tasks should be
+	// preempted, n is 0 if there is no need.
+	PreemptAt(now time.Time) (at time.Time, n int)
+	// Preemptible reports whether the running task t may be preempted
+	// early.
+	Preemptible(t *Task) bool
+}
+
+// Remover is an optional interface of a Policy. It is used to take a task
+// out of the run queues as soon as it is dropped because of a cancellation,
+// instead of waiting for it to be picked and discarded.
+type Remover interface {
+	// Remove takes the queued task t out of the run queues, it returns
+	// false if t is not queued or could not be removed. OnEnd follows a
+	// successful Remove.
+	Remove(t *Task) bool
+}
+
+// sliceCapper is an optional interface of a Policy, the ones of this
+// package only. capTimeSlice returns the cap the Workers must at least have
+// on the time slices for the policy to work as intended, see
+// NewWorkersWithOptions.
+type sliceCapper interface {
+	capTimeSlice() time.Duration
+}
+
+type TaskClass int
+
+const (
+	// the task has not been picked yet
+	ClassNone TaskClass = iota
+	ClassNew
+	ClassEventIntensive
+	ClassCPUIntensive
+	// a task with a deadline run by the policy from NewEDFPolicy
+	ClassDeadline
+
+	numTaskClasses
+)
+
+func (c TaskClass) String() string {
+	switch c {
+	case ClassNone:
+		return "none"
+	case ClassNew:
+		return "new"
+	case ClassEventIntensive:
+		return "event-intensive"
+	case ClassCPUIntensive:
+		return "cpu-intensive"
+	case ClassDeadline:
+		return "deadline"
+	}
+	return "unknown"
+}
+
+// classOf classifies t as a policy without a queue per class would
+func classOf(t *Task) TaskClass {
+	if t.Stat() == STAT_NEW {
+		return ClassNew
+	}
+	if eiFactorBt0(t.EIfactor()) {
+		return ClassEventIntensive
+	}
+	return ClassCPUIntensive
+}
+
+// The accessors below are meant for Policy implementations, and are only
+// safe to call from the Policy methods.
+
+// ID returns the id of the task, unique within its Workers.
+func (t *Task) ID() uint64 {
+	return t.id
+}
+
+// Name returns the name set by WithTaskName.
+func (t *Task) Name() string {
+	return t.name
+}
+
+// Stat returns one of STAT_NEW, STAT_RUNNING, STAT_SUSPENDED and STAT_END.
+func (t *Task) Stat() uint32 {
+	return t.loadStat()
+}
+
+// Class returns the class the task was last picked as.
+func (t *Task) Class() TaskClass {
+	return t.class
+}
+
+// EventIntensive reports the eiFlag passed at submission.
+func (t *Task) EventIntensive() bool {
+	return t.eventIntensiveFlag
+}
+
+// EIfactor returns the event intensive factor calculated from the last run,
+// 0 means the task is considered cpu intensive.
+func (t *Task) EIfactor() float32 {
+	return t.timing.eIfactor
+}
+
+// MaxTimeSlice returns the time slice requested at submission.
+func (t *Task) MaxTimeSlice() time.Duration {
+	return t.initMaxTimeSlice
+}
+
+// QueuedAt returns when the task became runnable the last time, i.e. when
+// it was submitted, yielded or returned from an event routine.
+func (t *Task) QueuedAt() time.Time {
+	return t.queuedT
+}
+
+// LastRunDuration returns how long the task held its P in the last run.
+func (t *Task) LastRunDuration() time.Duration {
+	return t.timing.suspendedCpuT.Sub(t.timing.resumeCpuT)
+}
+
+// LastEventCallDuration returns how long the last event routine took, or 0
+// if the last run did not end with an event call.
+func (t *Task) LastEventCallDuration() time.Duration {
+	return t.timing.endEventCallT.Sub(t.timing.enterEventCallT)
+}
+
+// Nice returns the nice value set by WithNice.
+func (t *Task) Nice() int {
+	return t.nice
+}
+
+// Deadline returns the deadline set by WithDeadline, ok is false if none.
+func (t *Task) Deadline() (deadline time.Time, ok bool) {
+	return t.deadline, !t.deadline.IsZero()
+}
+
+// PolicyData returns the value set by SetPolicyData.
+func (t *Task) PolicyData() interface{} {
+	return t.policyData
+}
+
+// SetPolicyData attaches per-task state of the Policy to t.
+func (t *Task) SetPolicyData(v interface{}) {
+	t.policyData = v
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"runtime/pprof"
+)
+
+// the standard pprof labels of the task routines, see WithPprofLabels
+const (
+	// the name of the Workers, see WithWorkersName
+	LabelWorkers = "cpuworker_workers"
+	// the name of the task, see WithTaskName
+	LabelTask = "cpuworker_task"
+	// the class the task is running as, see TaskClass
+	LabelClass = "cpuworker_class"
+)
+
+// setPprofLabels labels the task routine with the pprof labels carried by
+// the context of the task and, if WithPprofLabels, with the task labels and
+// the standard labels on top of them. It is called by the task routine each
+// time it is resumed, as the class may have changed.
+func (t *Task) setPprofLabels() {
+	if !t.w.pprofLabels {
+		if t.labelCtxs[ClassNone] == nil {
+			// only once, this also drops the labels inherited from the
+			// scheduler routine
+			t.labelCtxs[ClassNone] = t.ctx
+			pprof.SetGoroutineLabels(t.ctx)
+		}
+		return
+	}
+	class := t.class
+	if class < 0 || class >= numTaskClasses {
+		class = ClassNone
+	}
+	ctx := t.labelCtxs[class]
+	if ctx == nil {
+		labels := make([]string, 0, 6+2*len(t.labels))
+		for k, v := range t.labels {
+			labels = append(labels, k, v)
+		}
+		labels = append(labels, LabelClass, class.String())
+		if t.w.name != "" {
+			labels = append(labels, LabelWorkers, t.w.name)
+		}
+		if t.name != "" {
+			labels = append(labels, LabelTask, t.name)
+		}
+		ctx = pprof.WithLabels(t.ctx, pprof.Labels(labels...))
+		t.labelCtxs[class] = ctx
+	}
+	pprof.SetGoroutineLabels(ctx)
+}
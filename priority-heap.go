@@ -14,10 +14,16 @@
 
 package cpuworker
 
+import (
+	"container/heap"
+)
+
 type prioTaskHeapUnit struct {
 	score float32
 	seq   uint64
 	t     *Task
+	// index in prioTaskHeap, maintained by Swap, Push and Pop
+	idx int
 }
 
 // cmpPrio
@@ -44,48 +50,59 @@ func cmpPrio(u1, u2 *prioTaskHeapUnit) int {
 	}
 }
 
-type prioTaskHeap []prioTaskHeapUnit
+// prioTaskHeap implements heap.Interface as a max-heap of cmpPrio, it must
+// only be manipulated through container/heap
+type prioTaskHeap []*prioTaskHeapUnit
 
 func (h prioTaskHeap) Len() int { return len(h) }
 
 func (h prioTaskHeap) Less(i, j int) bool {
-	if cmpPrio(&h[i], &h[j]) == 1 {
+	if cmpPrio(h[i], h[j]) == 1 {
 		return true
 	} else {
 		return false
 	}
 }
 
-func (h prioTaskHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h prioTaskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
 
 func (h *prioTaskHeap) Push(x interface{}) {
 	// Push and Pop use pointer receivers because they modify the slice's length,
 	// not just its contents.
-	*h = append(*h, x.(prioTaskHeapUnit))
-}
-
-func (h *prioTaskHeap) PeekTopest() prioTaskHeapUnit {
-	assert(h.Len() > 0)
-	return (*h)[0]
+	u := x.(*prioTaskHeapUnit)
+	u.idx = len(*h)
+	*h = append(*h, u)
 }
 
 func (h *prioTaskHeap) Pop() interface{} {
 	old := *h
 	n := len(old)
 	x := old[n-1]
+	old[n-1] = nil
+	x.idx = -1
 	*h = old[0 : n-1]
 	return x
 }
 
+// prioTaskQueue is an indexed priority queue of tasks, the one with the
+// highest score is popped first. Push, Pop, Update and Remove are
+// O(log n), PeekTopest is O(1).
 type prioTaskQueue struct {
 	// max allocated seq
 	seq uint64
 	h   prioTaskHeap
+	// every queued task to its unit in h
+	units map[*Task]*prioTaskHeapUnit
 }
 
 func newPrioTaskQueue() *prioTaskQueue {
 	return &prioTaskQueue{
-		h: make(prioTaskHeap, 0, 128),
+		h:     make(prioTaskHeap, 0, 128),
+		units: make(map[*Task]*prioTaskHeapUnit, 128),
 	}
 }
 
@@ -95,25 +112,61 @@ func (pq *prioTaskQueue) Len() int {
 
 func (pq *prioTaskQueue) Pop() prioTaskHeapUnit {
 	assert(pq.Len() > 0)
-	pu, ok := pq.h.Pop().(prioTaskHeapUnit)
+	pu, ok := heap.Pop(&pq.h).(*prioTaskHeapUnit)
 	assert(ok)
-	return pu
+	delete(pq.units, pu.t)
+	return *pu
 }
 
 func (pq *prioTaskQueue) PeekTopest() prioTaskHeapUnit {
 	assert(pq.Len() > 0)
-	return pq.h.PeekTopest()
+	return *pq.h[0]
 }
 
+// Push queues t, which must not be queued already.
 func (pq *prioTaskQueue) Push(t *Task, score float32) {
 	seq := pq.seq + 1
 	pq.seq = seq
 	assert(seq != 0 && t != nil && score >= 0)
-	pu := prioTaskHeapUnit{
+	_, ok := pq.units[t]
+	assert(!ok)
+	pu := &prioTaskHeapUnit{
 		score: score,
 		seq:   seq,
 		t:     t,
 	}
-	pq.h.Push(pu)
+	heap.Push(&pq.h, pu)
+	pq.units[t] = pu
 	return
 }
+
+// Walk calls fn on every queued task, in no particular order.
+func (pq *prioTaskQueue) Walk(fn func(t *Task)) {
+	for _, pu := range pq.h {
+		fn(pu.t)
+	}
+}
+
+// Update changes the score of the queued task t in place, its seq is kept.
+// It returns false if t is not queued.
+func (pq *prioTaskQueue) Update(t *Task, score float32) bool {
+	assert(score >= 0)
+	pu, ok := pq.units[t]
+	if !ok {
+		return false
+	}
+	pu.score = score
+	heap.Fix(&pq.h, pu.idx)
+	return true
+}
+
+// Remove takes t out of the queue, it returns false if t is not queued.
+func (pq *prioTaskQueue) Remove(t *Task) bool {
+	pu, ok := pq.units[t]
+	if !ok {
+		return false
+	}
+	heap.Remove(&pq.h, pu.idx)
+	delete(pq.units, t)
+	return true
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// prioRef is the expected content of a prioTaskQueue
+type prioRef struct {
+	units []prioTaskHeapUnit
+}
+
+// top returns the index of the unit to be popped next
+func (r *prioRef) top() int {
+	best := 0
+	for i := range r.units {
+		if cmpPrio(&r.units[i], &r.units[best]) == 1 {
+			best = i
+		}
+	}
+	return best
+}
+
+func (r *prioRef) remove(i int) prioTaskHeapUnit {
+	u := r.units[i]
+	r.units[i] = r.units[len(r.units)-1]
+	r.units = r.units[:len(r.units)-1]
+	return u
+}
+
+func TestPrioTaskQueueOrder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		pq := newPrioTaskQueue()
+		var ref prioRef
+		for op := 0; op < 500; op++ {
+			switch k := rnd.Intn(12); {
+			case k < 5 || len(ref.units) == 0:
+				task := &Task{}
+				// few distinct scores so that ties are broken by seq
+				score := float32(rnd.Intn(8))
+				pq.Push(task, score)
+				ref.units = append(ref.units, prioTaskHeapUnit{score: score, seq: pq.seq, t: task})
+			case k < 8:
+				want := ref.remove(ref.top())
+				if top := pq.PeekTopest(); top.t != want.t {
+					t.Fatalf("round %d op %d: peeked score %v seq %d, want score %v seq %d",
+						round, op, top.score, top.seq, want.score, want.seq)
+				}
+				got := pq.Pop()
+				if got.t != want.t || got.score != want.score || got.seq != want.seq {
+					t.Fatalf("round %d op %d: popped score %v seq %d, want score %v seq %d",
+						round, op, got.score, got.seq, want.score, want.seq)
+				}
+			case k < 10:
+				// reprioritized in place, the seq is kept
+				i := rnd.Intn(len(ref.units))
+				score := float32(rnd.Intn(8))
+				if !pq.Update(ref.units[i].t, score) {
+					t.Fatalf("round %d op %d: queued task not updated", round, op)
+				}
+				ref.units[i].score = score
+				if pq.Update(&Task{}, score) {
+					t.Fatalf("round %d op %d: task not queued updated", round, op)
+				}
+			default:
+				want := ref.remove(rnd.Intn(len(ref.units)))
+				if !pq.Remove(want.t) {
+					t.Fatalf("round %d op %d: queued task not removed", round, op)
+				}
+				if pq.Remove(want.t) {
+					t.Fatalf("round %d op %d: removed task removed again", round, op)
+				}
+			}
+			if pq.Len() != len(ref.units) || len(pq.units) != len(ref.units) {
+				t.Fatalf("round %d op %d: len %d, %d units, want %d",
+					round, op, pq.Len(), len(pq.units), len(ref.units))
+			}
+		}
+		// drains in order
+		var last *prioTaskHeapUnit
+		for pq.Len() > 0 {
+			u := pq.Pop()
+			if last != nil && cmpPrio(last, &u) != 1 {
+				t.Fatalf("round %d: popped score %v seq %d after score %v seq %d",
+					round, u.score, u.seq, last.score, last.seq)
+			}
+			last = &u
+		}
+	}
+}
+
+func TestPrioTaskQueueUpdate(t *testing.T) {
+	pq := newPrioTaskQueue()
+	tasks := make([]Task, 4)
+	for i := range tasks {
+		pq.Push(&tasks[i], float32(i))
+	}
+	// the lowest to the top, the highest to the bottom
+	pq.Update(&tasks[0], 10)
+	pq.Update(&tasks[3], 0)
+	// tied with tasks[1], the higher seq of tasks[2] breaks the tie
+	pq.Update(&tasks[2], 1)
+	for _, want := range []*Task{&tasks[0], &tasks[2], &tasks[1], &tasks[3]} {
+		if got := pq.Pop(); got.t != want {
+			t.Fatalf("popped task %d, want task %d", taskIdx(tasks, got.t), taskIdx(tasks, want))
+		}
+	}
+}
+
+func taskIdx(tasks []Task, t *Task) int {
+	for i := range tasks {
+		if &tasks[i] == t {
+			return i
+		}
+	}
+	return -1
+}
+
+const (
+	// the tasks queued while benchmarking
+	benchQueued = 100000
+	// the operations timed between two refills of the queue
+	benchBatch = 10000
+)
+
+// newBenchQueue returns a queue holding benchQueued of the tasks, and the
+// benchBatch others
+func newBenchQueue(rnd *rand.Rand) (*prioTaskQueue, []*Task) {
+	pq := newPrioTaskQueue()
+	tasks := make([]Task, benchQueued+benchBatch)
+	others := make([]*Task, 0, benchBatch)
+	for i := range tasks {
+		if i < benchQueued {
+			pq.Push(&tasks[i], rnd.Float32()*1000)
+		} else {
+			others = append(others, &tasks[i])
+		}
+	}
+	return pq, others
+}
+
+func BenchmarkPush(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	pq, others := newBenchQueue(rnd)
+	scores := make([]float32, benchBatch)
+	for i := range scores {
+		scores[i] = rnd.Float32() * 1000
+	}
+	b.ResetTimer()
+	for done := 0; done < b.N; done += benchBatch {
+		n := b.N - done
+		if n > benchBatch {
+			n = benchBatch
+		}
+		for i := 0; i < n; i++ {
+			pq.Push(others[i], scores[i])
+		}
+		b.StopTimer()
+		for i := 0; i < n; i++ {
+			pq.Remove(others[i])
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkPop(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	pq, others := newBenchQueue(rnd)
+	for _, t := range others {
+		pq.Push(t, rnd.Float32()*1000)
+	}
+	popped := make([]prioTaskHeapUnit, 0, benchBatch)
+	b.ResetTimer()
+	for done := 0; done < b.N; done += benchBatch {
+		n := b.N - done
+		if n > benchBatch {
+			n = benchBatch
+		}
+		popped = popped[:0]
+		for i := 0; i < n; i++ {
+			popped = append(popped, pq.Pop())
+		}
+		b.StopTimer()
+		for _, u := range popped {
+			pq.Push(u.t, u.score)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkRemove(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	pq, others := newBenchQueue(rnd)
+	for _, t := range others {
+		pq.Push(t, rnd.Float32()*1000)
+	}
+	queued := make([]*Task, 0, len(pq.units))
+	for t := range pq.units {
+		queued = append(queued, t)
+	}
+	scores := make([]float32, benchBatch)
+	b.ResetTimer()
+	b.StopTimer()
+	for done := 0; done < b.N; done += benchBatch {
+		n := b.N - done
+		if n > benchBatch {
+			n = benchBatch
+		}
+		// random tasks, wherever they are in the heap
+		rnd.Shuffle(len(queued), func(i, j int) {
+			queued[i], queued[j] = queued[j], queued[i]
+		})
+		for i := 0; i < n; i++ {
+			scores[i] = pq.units[queued[i]].score
+		}
+		b.StartTimer()
+		for i := 0; i < n; i++ {
+			pq.Remove(queued[i])
+		}
+		b.StopTimer()
+		for i := 0; i < n; i++ {
+			pq.Push(queued[i], scores[i])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"runtime/trace"
+)
+
+// the regions of a task in the output of go tool trace, see
+// WithRuntimeTrace
+const (
+	traceRegionRunning    = "cpuworker.running"
+	traceRegionCheckpoint = "cpuworker.suspended-at-checkpoint"
+	traceRegionEventCall  = "cpuworker.in-eventCall"
+	traceRegionQueued     = "cpuworker.queued"
+)
+
+const traceLogCategory = "cpuworker"
+
+// traceStart wraps t in a trace.Task if w has runtime tracing enabled and
+// the runtime is being traced; tasks submitted before tracing starts are not
+// traced at all
+func (t *Task) traceStart() {
+	if !t.w.runtimeTrace || !trace.IsEnabled() {
+		return
+	}
+	t.traceCtx, t.traceTask = trace.NewTask(t.ctx, "cpuworker.Task")
+	trace.Logf(t.traceCtx, traceLogCategory, "submitted id=%d", t.id)
+}
+
+// traceRegion ends the current region of t, if any, and starts regionType,
+// it must be called by the task routine
+func (t *Task) traceRegion(regionType string) {
+	if t.traceCtx == nil {
+		return
+	}
+	if t.traceCurRegion != nil {
+		t.traceCurRegion.End()
+	}
+	t.traceCurRegion = trace.StartRegion(t.traceCtx, regionType)
+}
+
+// traceEnd ends the trace.Task of t, it must be called by the task routine
+// unless the task has never run
+func (t *Task) traceEnd(err error) {
+	if t.traceCtx == nil {
+		return
+	}
+	if t.traceCurRegion != nil {
+		t.traceCurRegion.End()
+		t.traceCurRegion = nil
+	}
+	if err != nil {
+		trace.Logf(t.traceCtx, traceLogCategory, "ended: %v", err)
+	}
+	t.traceTask.End()
+}
+
+// traceLog logs an event of the scheduler routine on t
+func (t *Task) traceLog(format string, args ...interface{}) {
+	if t.traceCtx == nil {
+		return
+	}
+	trace.Logf(t.traceCtx, traceLogCategory, format, args...)
+}
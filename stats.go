@@ -0,0 +1,378 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// histogramBounds are the upper bounds of the buckets of a Histogram
+var histogramBounds = [...]time.Duration{
+	time.Microsecond,
+	2 * time.Microsecond,
+	5 * time.Microsecond,
+	10 * time.Microsecond,
+	20 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	200 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Histogram is a distribution of durations.
+type Histogram struct {
+	// Counts[i] is the number of durations <= Bounds[i], and > Bounds[i-1]
+	// if any; the last one of Counts, which has no bound, is the number of
+	// durations > the last one of Bounds
+	Bounds []time.Duration
+	Counts []uint64
+	// the number and the sum of all the durations
+	Count uint64
+	Sum   time.Duration
+}
+
+// Quantile returns the upper bound of the bucket holding the q quantile,
+// the last one of Bounds if it is beyond that, 0 if h is empty.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	if rank < 1 {
+		rank = 1
+	}
+	var sum uint64
+	for i, ct := range h.Counts {
+		sum += ct
+		if sum >= rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// eIfactorBounds are the upper bounds of the buckets of a FactorHistogram
+var eIfactorBounds = [...]float64{0, 0.001, 0.01, 0.1, 1, 10, 100, 1000}
+
+// FactorHistogram is a distribution of eIfactors, laid out as a Histogram.
+type FactorHistogram struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+type factorHistogram struct {
+	counts [len(eIfactorBounds) + 1]uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *factorHistogram) observe(f float64) {
+	i := 0
+	for i < len(eIfactorBounds) && f > eIfactorBounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += f
+}
+
+func (h *factorHistogram) snapshot() FactorHistogram {
+	bounds := eIfactorBounds
+	counts := h.counts
+	return FactorHistogram{
+		Bounds: bounds[:],
+		Counts: counts[:],
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+}
+
+type durationHistogram struct {
+	counts [len(histogramBounds) + 1]uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+func (h *durationHistogram) snapshot() Histogram {
+	bounds := histogramBounds
+	counts := h.counts
+	return Histogram{
+		Bounds: bounds[:],
+		Counts: counts[:],
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+}
+
+// QueueLener is an optional interface of a Policy, used by Workers.Stats to
+// break the length of the run queues down by class.
+type QueueLener interface {
+	// QueueLens adds the number of queued tasks of each class to lens,
+	// which is indexed by TaskClass. Tasks which cannot be told apart may
+	// be counted as ClassNone.
+	QueueLens(lens []int)
+}
+
+// Stats is a snapshot of the scheduling statistics of a Workers, see
+// Workers.Stats.
+type Stats struct {
+	// the number of tasks in the run queues indexed by TaskClass, all of
+	// them are counted as ClassNone unless the policy is a QueueLener
+	QueueLen [numTaskClasses]int
+	// the number of P lent to the tasks, and idle
+	PBusy int
+	PIdle int
+	// the number of tasks received by the scheduler, ended after having
+	// run, and dropped before having run
+	Submitted uint64
+	Completed uint64
+	Dropped   uint64
+	// the number of times a task has yielded at a checkpoint, and returned
+	// from an event routine call
+	Yielded     uint64
+	EventCalled uint64
+	// the number of times a task has been signalled to yield, on its time
+	// slice running out or on behalf of a Preempter policy
+	Preemptions uint64
+	// the cpu time of all the tasks, and the time spent in their event
+	// routine calls
+	CPUTime       time.Duration
+	EventCallTime time.Duration
+	// from becoming runnable until being resumed
+	QueueWait Histogram
+	// from a task handing its P back until the scheduler has received it,
+	// only recorded if tracing is enabled, see WithTrace
+	PHandoffDelay Histogram
+	// from a task being signalled to yield until it has handed its P back
+	TimeSliceOverrun Histogram
+	// of the tasks, as calculated each time one has yielded or returned
+	// from an event routine call
+	EIfactor FactorHistogram
+	// every P by idx, including the retired ones
+	P []PSlot
+	// only listed by Workers.RunQueue
+	RunQueue []TaskInfo
+}
+
+// schedStats is only accessed by the scheduler routine
+type schedStats struct {
+	submitted     uint64
+	completed     uint64
+	yielded       uint64
+	eventCalled   uint64
+	preemptions   uint64
+	cpuTime       time.Duration
+	eventCallTime time.Duration
+
+	queueWait        durationHistogram
+	pHandoffDelay    durationHistogram
+	timeSliceOverrun durationHistogram
+	eIfactor         factorHistogram
+	// by the idx of P, the time lent to the tasks which have handed it
+	// back since
+	pLent []time.Duration
+}
+
+func (s *schedStats) addLent(idx int, d time.Duration) {
+	for len(s.pLent) <= idx {
+		s.pLent = append(s.pLent, 0)
+	}
+	if d > 0 {
+		s.pLent[idx] += d
+	}
+}
+
+// addTiming accounts the run, and the event routine call if any, which t
+// has just finished
+func (s *schedStats) addTiming(t *Task) {
+	tm := &t.timing
+	if tm.resumeCpuT != zeroT && tm.suspendedCpuT != zeroT {
+		if d := tm.suspendedCpuT.Sub(tm.resumeCpuT); d > 0 {
+			s.cpuTime += d
+		}
+	}
+	if tm.enterEventCallT != zeroT && tm.endEventCallT != zeroT {
+		if d := tm.endEventCallT.Sub(tm.enterEventCallT); d > 0 {
+			s.eventCallTime += d
+		}
+	}
+}
+
+func (s *schedStats) snapshot(w *Workers, policy Policy, pIdle, pBusy int) Stats {
+	st := Stats{
+		PBusy:            pBusy,
+		PIdle:            pIdle,
+		Submitted:        s.submitted,
+		Completed:        s.completed,
+		Dropped:          atomic.LoadUint64(&w.dropped),
+		Yielded:          s.yielded,
+		EventCalled:      s.eventCalled,
+		Preemptions:      s.preemptions,
+		CPUTime:          s.cpuTime,
+		EventCallTime:    s.eventCallTime,
+		QueueWait:        s.queueWait.snapshot(),
+		PHandoffDelay:    s.pHandoffDelay.snapshot(),
+		TimeSliceOverrun: s.timeSliceOverrun.snapshot(),
+		EIfactor:         s.eIfactor.snapshot(),
+	}
+	if ql, ok := policy.(QueueLener); ok {
+		ql.QueueLens(st.QueueLen[:])
+	} else {
+		st.QueueLen[ClassNone] = policy.Len()
+	}
+	return st
+}
+
+type statsReq struct {
+	// also list the run queues, see Workers.RunQueue
+	runQueue bool
+	reply    chan Stats
+}
+
+func (w *Workers) requestStats(runQueue bool) Stats {
+	req := statsReq{
+		runQueue: runQueue,
+		reply:    make(chan Stats, 1),
+	}
+	select {
+	case w.statsCh <- req:
+		return <-req.reply
+	case <-w.exitedCh:
+		return w.finalStats
+	}
+}
+
+// Stats returns a snapshot of the scheduling statistics of w, it is safe to
+// call from any goroutine. Once w is closed the last snapshot is returned.
+func (w *Workers) Stats() Stats {
+	return w.requestStats(false)
+}
+
+// RunQueue lists the tasks in the run queues of w, in no particular order.
+// It is empty unless the policy is a QueueWalker.
+func (w *Workers) RunQueue() []TaskInfo {
+	return w.requestStats(true).RunQueue
+}
+
+// the states of PSlot
+const (
+	// lent to a task which is running
+	PStateRunning = "running"
+	// lent to a task which has been signalled to yield
+	PStateSignalled = "signalled"
+	// being handed back to the scheduler
+	PStateReturning = "returning"
+	PStateIdle      = "idle"
+	// retired by SetMaxP
+	PStateRetired = "retired"
+)
+
+// PSlot describes a P of a Workers, see Stats.P.
+type PSlot struct {
+	Idx   int
+	State string
+	// of the task holding the P if running or signalled
+	TaskID     uint64
+	Class      TaskClass
+	RunningFor time.Duration
+	TimeSlice  time.Duration
+	// the total time lent to the tasks, including RunningFor; the
+	// utilization of the P is its increase over a period
+	LentTime time.Duration
+	// signalled on behalf of a Preempter policy rather than on the time
+	// slice running out
+	Preempted bool
+}
+
+// pSlots describes every P, it must be called by the scheduler routine
+func (w *Workers) pSlots(idle []*P, retired []int) []PSlot {
+	now := time.Now()
+	slots := make([]PSlot, len(w.taskSchArray))
+	for idx := range slots {
+		slots[idx].Idx = idx
+		slots[idx].State = PStateReturning
+		if idx < len(w.stats.pLent) {
+			slots[idx].LentTime = w.stats.pLent[idx]
+		}
+	}
+	for _, p := range idle {
+		slots[p.idx].State = PStateIdle
+	}
+	for _, idx := range retired {
+		slots[idx].State = PStateRetired
+	}
+	for idx, tu := range w.taskSchArray {
+		if tu.taskPtr == nil {
+			continue
+		}
+		s := &slots[idx]
+		s.State = PStateRunning
+		if !tu.signalT.IsZero() {
+			s.State = PStateSignalled
+		}
+		s.Preempted = tu.preempted
+		s.TaskID = tu.taskPtr.id
+		s.Class = TaskClass(atomic.LoadInt32(&tu.taskPtr.infoClass))
+		s.RunningFor = now.Sub(tu.resumeT)
+		s.TimeSlice = tu.timeSlice
+		s.LentTime += s.RunningFor
+	}
+	return slots
+}
+
+// QueueWalker is an optional interface of a Policy, used by
+// Workers.RunQueue to list the run queues.
+type QueueWalker interface {
+	// WalkQueue calls fn on every queued task
+	WalkQueue(fn func(t *Task))
+}
+
+// runQueueInfo lists the run queues of policy, it must be called by the
+// scheduler routine
+func runQueueInfo(policy Policy) []TaskInfo {
+	qw, ok := policy.(QueueWalker)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	infos := make([]TaskInfo, 0, policy.Len())
+	qw.WalkQueue(func(t *Task) {
+		infos = append(infos, t.info(now))
+	})
+	return infos
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"time"
+)
+
+// TaskAccounting is what a task has been through over its lifetime, see
+// TaskHandle.Accounting.
+type TaskAccounting struct {
+	// time run under a P
+	CPUTime time.Duration
+	// time spent inside the event routine calls
+	EventCallTime time.Duration
+	// time from becoming runnable until running again, summed over every
+	// time the task was queued; for a task dropped before having run, the
+	// time until it was dropped
+	QueueWait time.Duration
+	// the number of times the task yielded at a checkpoint, and called an
+	// event routine
+	Yields     int
+	EventCalls int
+	// the eIfactor the task was last resumed with
+	EIfactor float32
+	// the class the task has run the longest as, ClassNone if it never ran
+	Class TaskClass
+}
+
+// taskAccounting is accumulated by the timing functions of Task
+type taskAccounting struct {
+	queueWait     time.Duration
+	eventCallTime time.Duration
+	yields        int
+	eventCalls    int
+	eIfactor      float32
+	// the cpu time run as each class
+	classTime [numTaskClasses]time.Duration
+}
+
+func (a *taskAccounting) addRun(class TaskClass, d time.Duration) {
+	if d > 0 && class >= 0 && class < numTaskClasses {
+		a.classTime[class] += d
+	}
+}
+
+func (a *taskAccounting) export() TaskAccounting {
+	acct := TaskAccounting{
+		EventCallTime: a.eventCallTime,
+		QueueWait:     a.queueWait,
+		Yields:        a.yields,
+		EventCalls:    a.eventCalls,
+		EIfactor:      a.eIfactor,
+		Class:         ClassNone,
+	}
+	var longest time.Duration
+	for class, d := range a.classTime {
+		acct.CPUTime += d
+		if d > longest {
+			longest = d
+			acct.Class = TaskClass(class)
+		}
+	}
+	return acct
+}
+
+// Accounting returns what the task has been through, ok is false before the
+// task ends.
+func (h *TaskHandle) Accounting() (acct TaskAccounting, ok bool) {
+	select {
+	case <-h.done:
+		return h.acct, true
+	default:
+		return TaskAccounting{}, false
+	}
+}
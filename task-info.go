@@ -0,0 +1,93 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// TaskInfo is a snapshot of a live task, see Workers.Tasks.
+type TaskInfo struct {
+	ID uint64
+	// set by WithTaskName and WithTaskLabels
+	Name   string
+	Labels map[string]string
+	// one of STAT_NEW, STAT_RUNNING and STAT_SUSPENDED
+	Stat uint32
+	// the idx of the P held by the task, -1 if none
+	P int
+	// the class the task was last picked as, ClassNone if never
+	Class TaskClass
+	// the eiFlag passed at submission, and the eIfactor as of the last
+	// time the task yielded or returned from an event routine call
+	EventIntensive bool
+	EIfactor       float32
+	// since the task was submitted, and since it entered Stat
+	Age     time.Duration
+	StatAge time.Duration
+	// run under a P, including the current run if Stat is STAT_RUNNING
+	CPUTime time.Duration
+}
+
+// info takes a snapshot of t, it is safe to call from any goroutine
+func (t *Task) info(now time.Time) TaskInfo {
+	var labels map[string]string
+	if len(t.labels) > 0 {
+		labels = make(map[string]string, len(t.labels))
+		for k, v := range t.labels {
+			labels[k] = v
+		}
+	}
+	stat := t.loadStat()
+	statAge := now.Sub(time.Unix(0, atomic.LoadInt64(&t.infoStatT)))
+	cpuTime := time.Duration(atomic.LoadInt64(&t.infoCPUTime))
+	if stat == STAT_RUNNING {
+		cpuTime += statAge
+	}
+	return TaskInfo{
+		ID:             t.id,
+		Name:           t.name,
+		Labels:         labels,
+		Stat:           stat,
+		P:              int(atomic.LoadInt32(&t.infoP)),
+		Class:          TaskClass(atomic.LoadInt32(&t.infoClass)),
+		EventIntensive: t.eventIntensiveFlag,
+		EIfactor:       math.Float32frombits(atomic.LoadUint32(&t.infoEIfactor)),
+		Age:            now.Sub(t.submitT),
+		StatAge:        statAge,
+		CPUTime:        cpuTime,
+	}
+}
+
+// Tasks lists every task of w which has not ended yet, in the order of
+// their ID. It is safe to call from any goroutine, but the tasks keep
+// running while they are listed, so the fields of a TaskInfo may be read
+// from slightly different moments.
+func (w *Workers) Tasks() []TaskInfo {
+	now := time.Now()
+	w.lock.Lock()
+	infos := make([]TaskInfo, 0, len(w.tasks))
+	for t := range w.tasks {
+		infos = append(infos, t.info(now))
+	}
+	w.lock.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"time"
+)
+
+// TaskOption configures a task at submission, see SubmitCtx and Go.
+type TaskOption func(t *Task)
+
+const (
+	MinNice = -20
+	MaxNice = 19
+)
+
+// WithNice sets the nice value of the task, in the same sense as the nice
+// value of a Linux process: the lower it is the bigger share of cpu time
+// the task gets. It is clamped into [MinNice, MaxNice] and only honoured by
+// policies which support it, e.g. the one from NewCFSPolicy.
+func WithNice(nice int) TaskOption {
+	if nice < MinNice {
+		nice = MinNice
+	}
+	if nice > MaxNice {
+		nice = MaxNice
+	}
+	return func(t *Task) {
+		t.nice = nice
+	}
+}
+
+// WithTaskName names the task, e.g. in its pprof labels, see
+// WithPprofLabels.
+func WithTaskName(name string) TaskOption {
+	return func(t *Task) {
+		t.name = name
+	}
+}
+
+// WithTaskLabels attaches labels to the task, see TaskInfo. They are also
+// added to its pprof labels, see WithPprofLabels.
+func WithTaskLabels(labels map[string]string) TaskOption {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return func(t *Task) {
+		t.labels = copied
+	}
+}
+
+// WithDeadline attaches an absolute deadline to the task. If the task has
+// not started by then, it is dropped and its handle reports
+// ErrDeadlineExceeded. The policy from NewEDFPolicy also runs the tasks
+// having a deadline in earliest-deadline-first order.
+func WithDeadline(deadline time.Time) TaskOption {
+	return func(t *Task) {
+		t.deadline = deadline
+	}
+}
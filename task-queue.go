@@ -0,0 +1,62 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+// taskFifo is an unbounded FIFO queue of tasks
+type taskFifo struct {
+	head int
+	ts   []*Task
+}
+
+func (q *taskFifo) Len() int {
+	return len(q.ts) - q.head
+}
+
+func (q *taskFifo) Push(t *Task) {
+	assert(t != nil)
+	if q.head > 0 && q.head == len(q.ts) {
+		q.head = 0
+		q.ts = q.ts[:0]
+	}
+	q.ts = append(q.ts, t)
+}
+
+// Tasks returns the queued tasks from the head, the slice must not be
+// modified and is only valid until the next Push or Pop
+func (q *taskFifo) Tasks() []*Task {
+	return q.ts[q.head:]
+}
+
+func (q *taskFifo) Peek() *Task {
+	assert(q.Len() > 0)
+	return q.ts[q.head]
+}
+
+func (q *taskFifo) Pop() *Task {
+	assert(q.Len() > 0)
+	t := q.ts[q.head]
+	q.ts[q.head] = nil
+	q.head++
+	// reclaim the consumed prefix once it dominates the backing array
+	if q.head >= 1024 && q.head*2 >= len(q.ts) {
+		n := copy(q.ts, q.ts[q.head:])
+		for i := n; i < len(q.ts); i++ {
+			q.ts[i] = nil
+		}
+		q.ts = q.ts[:n]
+		q.head = 0
+	}
+	return t
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"sync"
+	"time"
+)
+
+// tickLoop runs a function periodically in a routine of its own, between
+// start and stop. It is the lifecycle of AutoSizer and LatencyController.
+type tickLoop struct {
+	// guards started and stopped
+	lock    sync.Mutex
+	started bool
+	stopped bool
+	stopCh  chan struct{}
+	// closed once the routine has returned, or by stop if never started
+	doneCh chan struct{}
+}
+
+func newTickLoop() *tickLoop {
+	return &tickLoop{
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// start calls tick every interval until stop is called or exitCh is
+// closed, and also right away if first is true. It does nothing if l has
+// been started or stopped already.
+func (l *tickLoop) start(interval time.Duration, exitCh <-chan struct{}, tick func(), first bool) {
+	l.lock.Lock()
+	if l.started || l.stopped {
+		l.lock.Unlock()
+		return
+	}
+	l.started = true
+	l.lock.Unlock()
+	if first {
+		tick()
+	}
+	go l.run(interval, exitCh, tick)
+}
+
+func (l *tickLoop) run(interval time.Duration, exitCh <-chan struct{}, tick func()) {
+	defer close(l.doneCh)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tick()
+		case <-l.stopCh:
+			return
+		case <-exitCh:
+			return
+		}
+	}
+}
+
+// stop stops l, if started, and waits for its routine to return.
+func (l *tickLoop) stop() {
+	l.lock.Lock()
+	if !l.stopped {
+		l.stopped = true
+		if l.started {
+			close(l.stopCh)
+		} else {
+			close(l.doneCh)
+		}
+	}
+	l.lock.Unlock()
+	<-l.doneCh
+}
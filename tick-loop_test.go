@@ -0,0 +1,82 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"testing"
+	"time"
+)
+
+// waitStopped calls stop twice, as a second Stop must return as well, and
+// fails t if it blocks
+func waitStopped(t *testing.T, stop func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		stop()
+		stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop has not returned")
+	}
+}
+
+func TestTickLoop(t *testing.T) {
+	exitCh := make(chan struct{})
+
+	// never started
+	waitStopped(t, newTickLoop().stop)
+
+	// stopped, then never starts
+	l := newTickLoop()
+	l.stop()
+	l.start(time.Millisecond, exitCh, func() {
+		t.Error("ticked after stop")
+	}, true)
+
+	ticks := make(chan struct{}, 16)
+	l = newTickLoop()
+	tick := func() {
+		select {
+		case ticks <- struct{}{}:
+		default:
+		}
+	}
+	l.start(time.Millisecond, exitCh, tick, true)
+	// the first tick is synchronous
+	if len(ticks) == 0 {
+		t.Fatal("not ticked by start")
+	}
+	l.start(time.Millisecond, exitCh, func() {
+		t.Error("started twice")
+	}, true)
+	<-ticks
+	<-ticks
+	waitStopped(t, l.stop)
+
+	// ends with exitCh as well
+	l = newTickLoop()
+	l.start(time.Millisecond, exitCh, func() {}, false)
+	close(exitCh)
+	select {
+	case <-l.doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ended by exitCh")
+	}
+	waitStopped(t, l.stop)
+}
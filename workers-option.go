@@ -0,0 +1,348 @@
+// Copyright 2021 The cpuworker Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuworker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// a task whose eIfactor is not above it is not event intensive
+	DefaultEIThreshold = 0.0001
+	// a task which has run this long or longer before yielding is not
+	// event intensive
+	DefaultEICPUCutoff = time.Millisecond
+)
+
+// ErrInvalidOption is wrapped by the errors of NewWorkersWithOptions.
+var ErrInvalidOption = errors.New("cpuworker: invalid option")
+
+// Option configures a Workers created by NewWorkersWithOptions.
+type Option func(c *workersConfig)
+
+type workersConfig struct {
+	p            int
+	maxTimeSlice time.Duration
+	// set by WithMaxTimeSlice, otherwise maxTimeSlice may be raised for the
+	// policy, see sliceCapper
+	maxTimeSliceSet bool
+	// 0 means the default of the default policy
+	eiTaskTimeSlice  time.Duration
+	newTaskTimeSlice time.Duration
+	// 0 means 1024 per P
+	queueCap      int
+	eiThreshold   float32
+	eiCPUCutoff   time.Duration
+	trace         bool
+	runtimeTrace  bool
+	recorder      *FlightRecorder
+	name          string
+	pprofLabels   bool
+	policy        Policy
+	repanicOnSync bool
+	hooks         Hooks
+	// nil disables logging, see WithLogger
+	logger            *slog.Logger
+	logLevel          slog.Leveler
+	slowTaskFactor    float64
+	logSampleInterval time.Duration
+}
+
+func defaultWorkersConfig() workersConfig {
+	return workersConfig{
+		p:            CalcAutoP(),
+		maxTimeSlice: DefaultMaxTimeSlice,
+		eiThreshold:  DefaultEIThreshold,
+		eiCPUCutoff:  DefaultEICPUCutoff,
+		trace:        true,
+
+		slowTaskFactor:    DefaultSlowTaskFactor,
+		logSampleInterval: DefaultLogSampleInterval,
+	}
+}
+
+// WithP sets the number of P, CalcAutoP() by default.
+func WithP(p int) Option {
+	return func(c *workersConfig) {
+		c.p = p
+	}
+}
+
+// WithMaxTimeSlice sets the cap on the time slice of every task,
+// DefaultMaxTimeSlice by default, or the TargetLatency of the policy from
+// NewCFSPolicy if greater.
+func WithMaxTimeSlice(d time.Duration) Option {
+	return func(c *workersConfig) {
+		c.maxTimeSlice = d
+		c.maxTimeSliceSet = true
+	}
+}
+
+// WithEITaskTimeSlice sets the time slice of the event intensive tasks
+// under the default policy, MaxEITaskTimeslice by default.
+func WithEITaskTimeSlice(d time.Duration) Option {
+	return func(c *workersConfig) {
+		c.eiTaskTimeSlice = d
+	}
+}
+
+// WithNewTaskTimeSlice sets the time slice of the new tasks under the
+// default policy, MaxNewTaskTimeslice by default.
+func WithNewTaskTimeSlice(d time.Duration) Option {
+	return func(c *workersConfig) {
+		c.newTaskTimeSlice = d
+	}
+}
+
+// WithQueueCapacity sets how many new tasks, and how many task events, may
+// be buffered before the submitters block, 1024 per P by default.
+func WithQueueCapacity(n int) Option {
+	return func(c *workersConfig) {
+		c.queueCap = n
+	}
+}
+
+// WithEIThreshold sets the eIfactor a task must be above to be event
+// intensive, DefaultEIThreshold by default.
+func WithEIThreshold(threshold float32) Option {
+	return func(c *workersConfig) {
+		c.eiThreshold = threshold
+	}
+}
+
+// WithEICPUCutoff sets how long a task may run before yielding and still be
+// event intensive, DefaultEICPUCutoff by default.
+func WithEICPUCutoff(d time.Duration) Option {
+	return func(c *workersConfig) {
+		c.eiCPUCutoff = d
+	}
+}
+
+// WithTrace enables recording the P handoff delay, see GetTraceMaxPdelay.
+// It is enabled by default.
+func WithTrace(on bool) Option {
+	return func(c *workersConfig) {
+		c.trace = on
+	}
+}
+
+// WithRuntimeTrace wraps every task submitted while the runtime is being
+// traced, see runtime/trace.Start, in a trace.Task. In the output of go tool
+// trace the task routine is then marked with a region for each of running,
+// suspended at a checkpoint, inside an event routine call and queued after
+// it, and the scheduler logs when it resumes or preempts the task. It is
+// disabled by default.
+func WithRuntimeTrace(on bool) Option {
+	return func(c *workersConfig) {
+		c.runtimeTrace = on
+	}
+}
+
+// WithFlightRecorder records the scheduling timeline into fr, see
+// Workers.SetFlightRecorder.
+func WithFlightRecorder(fr *FlightRecorder) Option {
+	return func(c *workersConfig) {
+		c.recorder = fr
+	}
+}
+
+// WithWorkersName names the Workers, e.g. in its pprof labels.
+func WithWorkersName(name string) Option {
+	return func(c *workersConfig) {
+		c.name = name
+	}
+}
+
+// WithPprofLabels adds the standard pprof labels, LabelWorkers, LabelTask
+// and LabelClass, to the task routines. It is disabled by default.
+//
+// Every task routine is labelled with the pprof labels carried by the
+// context of the task, see runtime/pprof.Do and SubmitCtx; the task labels,
+// see WithTaskLabels, and the standard labels are added on top of them. The
+// labels set on the submitting goroutine alone, e.g. by
+// runtime/pprof.SetGoroutineLabels, are not inherited: submit with the
+// context passed by runtime/pprof.Do to keep them.
+func WithPprofLabels(on bool) Option {
+	return func(c *workersConfig) {
+		c.pprofLabels = on
+	}
+}
+
+// WithPolicy sets the scheduling policy, which must not be shared with any
+// other Workers. The one from NewDefaultPolicy is used by default.
+func WithPolicy(policy Policy) Option {
+	return func(c *workersConfig) {
+		c.policy = policy
+	}
+}
+
+// WithHooks calls h on the scheduling transitions of every task, see Hooks.
+func WithHooks(h Hooks) Option {
+	return func(c *workersConfig) {
+		c.hooks = h
+	}
+}
+
+// WithLogger logs to logger when the Workers is created, when a task
+// overruns its time slice, see WithSlowTaskFactor, when submitters are
+// blocked on a saturated new task queue until it drains, see
+// WithQueueCapacity, and the state of the task before panicking on a
+// violated invariant. Nothing is logged by default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *workersConfig) {
+		c.logger = logger
+	}
+}
+
+// WithLogLevel sets the lowest level logged to the logger of WithLogger,
+// slog.LevelInfo by default.
+func WithLogLevel(level slog.Leveler) Option {
+	return func(c *workersConfig) {
+		c.logLevel = level
+	}
+}
+
+// WithSlowTaskFactor logs a task which has held a P for longer than factor
+// times its time slice, DefaultSlowTaskFactor by default; 0 disables it.
+func WithSlowTaskFactor(factor float64) Option {
+	return func(c *workersConfig) {
+		c.slowTaskFactor = factor
+	}
+}
+
+// WithLogSampleInterval logs at most one slow task per interval, with the
+// number of the others left out since, DefaultLogSampleInterval by default;
+// 0 logs every one.
+func WithLogSampleInterval(interval time.Duration) Option {
+	return func(c *workersConfig) {
+		c.logSampleInterval = interval
+	}
+}
+
+// WithRepanicOnSync is the initial value of Workers.SetRepanicOnSync.
+func WithRepanicOnSync(on bool) Option {
+	return func(c *workersConfig) {
+		c.repanicOnSync = on
+	}
+}
+
+// WorkersConfig is the configuration of a Workers, see Workers.Config.
+type WorkersConfig struct {
+	Name string
+	// the P wanted and alive, see SetMaxP, and their limit
+	MaxP         int
+	PInUse       int
+	PLimit       int
+	MaxTimeSlice time.Duration
+	// of the new task queue, see WithQueueCapacity
+	QueueCapacity  int
+	EIThreshold    float32
+	EICPUCutoff    time.Duration
+	Trace          bool
+	RuntimeTrace   bool
+	FlightRecorder bool
+	PprofLabels    bool
+	RepanicOnSync  bool
+	// the type of the Policy, e.g. "*cpuworker.defaultPolicy"
+	Policy string
+}
+
+// Config returns the current configuration of w.
+func (w *Workers) Config() WorkersConfig {
+	return WorkersConfig{
+		Name:           w.name,
+		MaxP:           w.GetMaxP(),
+		PInUse:         w.GetPInUse(),
+		PLimit:         w.GetPLimit(),
+		MaxTimeSlice:   w.GetMaxTimeSlice(),
+		QueueCapacity:  w.queueCap,
+		EIThreshold:    w.eiThreshold,
+		EICPUCutoff:    w.eiCPUCutoff,
+		Trace:          w.trace,
+		RuntimeTrace:   w.runtimeTrace,
+		FlightRecorder: w.getFlightRecorder() != nil,
+		PprofLabels:    w.pprofLabels,
+		RepanicOnSync:  atomic.LoadUint32(&w.repanicOnSync) != 0,
+		Policy:         fmt.Sprintf("%T", w.policy),
+	}
+}
+
+func (c *workersConfig) validate() error {
+	if c.p <= 0 {
+		return fmt.Errorf("%w: p %d must > 0", ErrInvalidOption, c.p)
+	}
+	if c.maxTimeSlice <= 0 {
+		return fmt.Errorf("%w: max time slice %v must > 0", ErrInvalidOption, c.maxTimeSlice)
+	}
+	if c.eiTaskTimeSlice < 0 || c.eiTaskTimeSlice > c.maxTimeSlice {
+		return fmt.Errorf("%w: event intensive task time slice %v must be >= 0 (0 = default) and <= %v",
+			ErrInvalidOption, c.eiTaskTimeSlice, c.maxTimeSlice)
+	}
+	if c.newTaskTimeSlice < 0 || c.newTaskTimeSlice > c.maxTimeSlice {
+		return fmt.Errorf("%w: new task time slice %v must be >= 0 (0 = default) and <= %v",
+			ErrInvalidOption, c.newTaskTimeSlice, c.maxTimeSlice)
+	}
+	if sc, ok := c.policy.(sliceCapper); ok && c.maxTimeSliceSet && c.maxTimeSlice < sc.capTimeSlice() {
+		return fmt.Errorf("%w: max time slice %v must be >= %v for the policy",
+			ErrInvalidOption, c.maxTimeSlice, sc.capTimeSlice())
+	}
+	if c.policy != nil && (c.eiTaskTimeSlice != 0 || c.newTaskTimeSlice != 0) {
+		return fmt.Errorf("%w: the event intensive and new task time slices only apply to the default policy",
+			ErrInvalidOption)
+	}
+	if c.queueCap < 0 {
+		return fmt.Errorf("%w: queue capacity %d must be >= 0 (0 = default)", ErrInvalidOption, c.queueCap)
+	}
+	if c.eiThreshold < 0 {
+		return fmt.Errorf("%w: event intensive threshold %v must >= 0", ErrInvalidOption, c.eiThreshold)
+	}
+	if c.slowTaskFactor != 0 && c.slowTaskFactor < 1 {
+		return fmt.Errorf("%w: slow task factor %v must be 0 or >= 1", ErrInvalidOption, c.slowTaskFactor)
+	}
+	if c.logSampleInterval < 0 {
+		return fmt.Errorf("%w: log sample interval %v must >= 0", ErrInvalidOption, c.logSampleInterval)
+	}
+	if c.eiCPUCutoff <= 0 {
+		return fmt.Errorf("%w: event intensive cpu cutoff %v must > 0", ErrInvalidOption, c.eiCPUCutoff)
+	}
+	return nil
+}
+
+// NewWorkersWithOptions creates a Workers configured by opts, see Option.
+// An invalid option, or combination of options, is reported as an error
+// wrapping ErrInvalidOption.
+func NewWorkersWithOptions(opts ...Option) (*Workers, error) {
+	cfg := defaultWorkersConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.policy == nil {
+		cfg.policy = NewDefaultPolicyWithConfig(DefaultPolicyConfig{
+			EITaskTimeSlice:  cfg.eiTaskTimeSlice,
+			NewTaskTimeSlice: cfg.newTaskTimeSlice,
+		})
+	}
+	if sc, ok := cfg.policy.(sliceCapper); ok && !cfg.maxTimeSliceSet && cfg.maxTimeSlice < sc.capTimeSlice() {
+		cfg.maxTimeSlice = sc.capTimeSlice()
+	}
+	return newWorkers(&cfg), nil
+}